@@ -1,17 +1,51 @@
 package common
 
 import (
+	"cmp"
+	"fmt"
+	"io/fs"
 	"path"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/wandel/vscmirror/marketplace"
 )
 
 var PLATFORMS = []string{"win32", "linux", "linux-deb", "linux-rpm", "darwin", "linux-snap", "server-linux", "server-linux-legacy", "cli-alpine"}
-var ARCHITECTURES = []string{"", "x64", "ia32"}
+var ARCHITECTURES = []string{"", "x64", "ia32", "arm64"}
 var BUILD_TYPES = []string{"", "archive", "user"}
 var QUALITY = []string{"stable", "insider"}
 
+// REMOTE_PLATFORMS are the server and cli builds remote development downloads
+// for the commit of the connecting client.
+var REMOTE_PLATFORMS = []string{"server-linux-x64", "server-linux-arm64", "server-linux-legacy-x64", "cli-alpine-x64"}
+
+// Identity joins the parts of an update server platform identity, skipping
+// the empty ones, e.g. "win32", "x64", "user" becomes "win32-x64-user".
+func Identity(platform, architecture, buildType string) string {
+	identity := platform
+	for _, part := range []string{architecture, buildType} {
+		if part != "" {
+			identity += "-" + part
+		}
+	}
+	return identity
+}
+
+// SplitIdentity splits an identity like "win32-x64-user" or
+// "server-linux-legacy-x64" back into its platform, architecture and build type.
+func SplitIdentity(identity string) (string, string, string) {
+	platform, architecture, buildType := identity, "", ""
+	if n := strings.LastIndex(platform, "-"); n > 0 && slices.Contains(BUILD_TYPES, platform[n+1:]) {
+		platform, buildType = platform[:n], platform[n+1:]
+	}
+	if n := strings.LastIndex(platform, "-"); n > 0 && slices.Contains(ARCHITECTURES, platform[n+1:]) {
+		platform, architecture = platform[:n], platform[n+1:]
+	}
+	return platform, architecture, buildType
+}
+
 type ProductInfoEx struct {
 	marketplace.ProductInfo
 	Identity         string `json:"identity"`
@@ -21,8 +55,21 @@ type ProductInfoEx struct {
 	Quality          string `json:"quality"`
 	CheckedForUpdate bool   `json:"checkedForUpdate"`
 	UpdateUrl        string `json:"updateUrl"`
+	// Mirrored is when the build first landed in the mirror.
+	Mirrored time.Time `json:"mirrored"`
+}
+
+// Landed returns when the build landed in the mirror, falling back to its
+// release time for metadata written before that was recorded.
+func (info ProductInfoEx) Landed() time.Time {
+	if info.Mirrored.IsZero() {
+		return time.UnixMilli(int64(info.Timestamp))
+	}
+	return info.Mirrored
 }
 
+// GetDownloadUrl returns the artifact path the installer is stored at. The
+// commit is part of the file name as insider builds reuse the same name.
 func (info ProductInfoEx) GetDownloadUrl() string {
 	_, filename := path.Split(info.UpdateUrl)
 	ext := path.Ext(filename)
@@ -31,5 +78,32 @@ func (info ProductInfoEx) GetDownloadUrl() string {
 		ext = ext + path.Ext(tmp)
 	}
 
-	return path.Join("installers", info.Identity, info.Quality, "vscode-"+info.Name+ext)
+	return path.Join("installers", info.Identity, info.Quality, "vscode-"+info.Name+"-"+info.Version+ext)
+}
+
+// LoadInstallers returns the mirrored builds of the platform and quality,
+// newest first.
+func LoadInstallers(root fs.FS, identity, quality string) ([]ProductInfoEx, error) {
+	matches, err := fs.Glob(root, path.Join("installers", identity, quality, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to glob installers: %w", err)
+	}
+
+	var history []ProductInfoEx
+	for _, match := range matches {
+		if path.Base(match) == "latest.json" {
+			continue
+		}
+
+		var installer ProductInfoEx
+		if err := LoadJsonFS(root, match, &installer); err != nil {
+			return nil, err
+		}
+		history = append(history, installer)
+	}
+
+	slices.SortFunc(history, func(a, b ProductInfoEx) int {
+		return cmp.Compare(b.Timestamp, a.Timestamp)
+	})
+	return history, nil
 }
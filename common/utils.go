@@ -1,6 +1,8 @@
 package common
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -8,8 +10,14 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 )
 
+// GenerationFile is written to the artifact root by every run that changes the
+// extension metadata, so a running server knows to reload.
+const GenerationFile = "generation"
+
 func Download(url string, path string) error {
 	resp, err := http.Get(url)
 	if err != nil {
@@ -46,6 +54,8 @@ func ReadFile(filename string, w io.Writer) error {
 	return nil
 }
 
+// WriteFile writes r to a temporary file next to filename and renames it into
+// place once complete, so readers never observe a partially written file.
 func WriteFile(filename string, r io.Reader, perm os.FileMode) error {
 	path, err := filepath.Abs(filename)
 	if err != nil {
@@ -53,23 +63,51 @@ func WriteFile(filename string, r io.Reader, perm os.FileMode) error {
 	}
 
 	parent := filepath.Dir(path)
-	if err := os.MkdirAll(parent, 0644); err != nil {
+	if err := os.MkdirAll(parent, 0755); err != nil {
 		return fmt.Errorf("failed to create parent directory '%s': %w", parent, err)
 	}
 
-	f, err := os.Create(filename)
+	f, err := os.CreateTemp(parent, filepath.Base(path)+".*.tmp")
 	if err != nil {
 		return fmt.Errorf("failed to create '%s': %w", filename, err)
 	}
+	defer os.Remove(f.Name())
 	defer f.Close()
 
 	if _, err := io.Copy(f, r); err != nil {
 		return fmt.Errorf("failed to write to '%s': %w", filename, err)
 	}
 
+	if err := f.Chmod(perm); err != nil {
+		return fmt.Errorf("failed to chmod '%s': %w", filename, err)
+	} else if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync '%s': %w", filename, err)
+	} else if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close '%s': %w", filename, err)
+	}
+
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("failed to move '%s' into place: %w", filename, err)
+	}
+
 	return nil
 }
 
+func HashFile(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", fmt.Errorf("failed to open '%s': %w", filename, err)
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", fmt.Errorf("failed to hash '%s': %w", filename, err)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
 func DownloadArtifact(url string) error {
 	resp, err := http.Get(url)
 	if err != nil {
@@ -119,3 +157,10 @@ func DownloadJson(url string, value any) error {
 
 	return nil
 }
+
+// ContainsFold reports whether values contains value, ignoring case.
+func ContainsFold(values []string, value string) bool {
+	return slices.ContainsFunc(values, func(v string) bool {
+		return strings.EqualFold(v, value)
+	})
+}
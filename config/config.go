@@ -0,0 +1,170 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/wandel/vscmirror/common"
+	"github.com/wandel/vscmirror/marketplace"
+)
+
+// Config describes a mirror, it is shared by the download, serve and search
+// commands so they agree on where artifacts live and where they come from.
+type Config struct {
+	// Root is the directory holding the mirrored artifacts.
+	Root string `json:"root"`
+	// BaseUrl is the public url vscode clients reach the mirror on.
+	BaseUrl string `json:"baseUrl"`
+	Address string `json:"address"`
+	Tls     Tls    `json:"tls"`
+	// ReloadInterval is how often serve checks whether a download changed the
+	// artifact root, zero only reloads on SIGHUP.
+	ReloadInterval Duration `json:"reloadInterval"`
+	Upstream       Upstream `json:"upstream"`
+	Download       Download `json:"download"`
+	// Installers selects the vscode builds to mirror.
+	Installers Installers `json:"installers"`
+	// Selection limits which extensions are mirrored, by default all of them.
+	Selection Selection `json:"selection"`
+	// Retention controls how many versions of each extension are kept.
+	Retention Retention `json:"retention"`
+	// Featured lists the "publisher.name" of the extensions served for @featured
+	// instead of the ones the marketplace features.
+	Featured []string `json:"featured"`
+}
+
+type Tls struct {
+	Certificate string `json:"certificate"`
+	Key         string `json:"key"`
+}
+
+// Upstream holds the endpoints the mirror is populated from.
+type Upstream struct {
+	// Gallery is the base url of the extension gallery api.
+	Gallery string `json:"gallery"`
+	// Update is the vscode update server.
+	Update string `json:"update"`
+	// Cdn hosts the malicious extension list.
+	Cdn string `json:"cdn"`
+	// Version is the vscode version reported to the gallery.
+	Version string `json:"version"`
+	// MaxRetries is how many times a throttled or failed gallery query is
+	// retried, a negative value disables retrying.
+	MaxRetries int `json:"maxRetries"`
+	// MinBackoff and MaxBackoff bound the delay between retries, MaxBackoff
+	// also caps how long a Retry-After header can make the sync wait.
+	MinBackoff Duration `json:"minBackoff"`
+	MaxBackoff Duration `json:"maxBackoff"`
+}
+
+type Download struct {
+	Workers int `json:"workers"`
+	// BytesPerSecond caps the total download bandwidth, zero is unlimited.
+	BytesPerSecond int64 `json:"bytesPerSecond"`
+	// RequestsPerSecond caps requests to the cdn and update server, zero is unlimited.
+	RequestsPerSecond float64 `json:"requestsPerSecond"`
+}
+
+// Installers lists the vscode builds to mirror, every combination of platform,
+// architecture and build type is looked up for each quality. Combinations the
+// update server does not know are skipped.
+type Installers struct {
+	Platforms     []string `json:"platforms"`
+	Architectures []string `json:"architectures"`
+	BuildTypes    []string `json:"buildTypes"`
+	Qualities     []string `json:"qualities"`
+	// Retain is how many builds are kept per platform and quality, the
+	// latest and pinned builds are always kept.
+	Retain int `json:"retain"`
+	// Groups name sets of client addresses or CIDR ranges that pins apply to.
+	Groups map[string][]string `json:"groups"`
+	// Pins hold clients on a specific build instead of the latest one.
+	Pins []Pin `json:"pins"`
+	// Rollout staggers new builds over the clients that are not pinned.
+	Rollout Rollout `json:"rollout"`
+	// Remote lists the vscode server and cli builds fetched for every mirrored
+	// client commit, so Remote-SSH, WSL and tunnels work offline.
+	Remote []string `json:"remote"`
+}
+
+func Default() Config {
+	return Config{
+		Root:           "D:\\vscmirror",
+		BaseUrl:        "https://vscode.cdn.local/",
+		Address:        "127.0.0.1:443",
+		ReloadInterval: Duration(30 * time.Second),
+		Tls: Tls{
+			Certificate: "visualstudio.com.crt",
+			Key:         "visualstudio.com.key",
+		},
+		Upstream: Upstream{
+			Gallery:    marketplace.DefaultBaseUrl,
+			Update:     "https://update.code.visualstudio.com",
+			Cdn:        "https://main.vscode-cdn.net",
+			Version:    "1.99.2",
+			MaxRetries: marketplace.DefaultMaxRetries,
+			MinBackoff: Duration(marketplace.DefaultMinBackoff),
+			MaxBackoff: Duration(marketplace.DefaultMaxBackoff),
+		},
+		Download: Download{
+			Workers: 4,
+		},
+		Installers: Installers{
+			Platforms:     common.PLATFORMS,
+			Architectures: common.ARCHITECTURES,
+			BuildTypes:    common.BUILD_TYPES,
+			Qualities:     []string{"stable"},
+			Remote:        common.REMOTE_PLATFORMS,
+		},
+	}
+}
+
+// Duration is a time.Duration written as a string like "36h" in json.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("duration must be a string: %w", err)
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(duration)
+	return nil
+}
+
+// Load reads the json config at filename on top of the defaults. A missing
+// file is only an error if required is set.
+func Load(filename string, required bool) (Config, error) {
+	config := Default()
+
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, fs.ErrNotExist) && !required {
+		return config, nil
+	} else if err != nil {
+		return config, fmt.Errorf("failed to read '%s': %w", filename, err)
+	}
+
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("failed to json decode '%s': %w", filename, err)
+	}
+
+	return config, nil
+}
+
+// Artifacts returns the artifact root as a filesystem.
+func (c Config) Artifacts() fs.FS {
+	return os.DirFS(c.Root)
+}
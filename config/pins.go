@@ -0,0 +1,89 @@
+package config
+
+import (
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// Pin advertises Commit to clients checking for updates instead of the latest
+// build. Empty Identity, Quality or Group fields match anything.
+type Pin struct {
+	// Identity is the update server platform identity, e.g. "win32-x64-user".
+	Identity string `json:"identity"`
+	Quality  string `json:"quality"`
+	Commit   string `json:"commit"`
+	// Group limits the pin to the clients in one of the Installers.Groups.
+	Group string `json:"group"`
+}
+
+// Pinned returns the commit the client should be held on, pins for a group the
+// client is in take precedence over pins for everyone.
+func (i Installers) Pinned(identity, quality string, client netip.Addr) (string, bool) {
+	var fallback *Pin
+	for n, pin := range i.Pins {
+		if pin.Identity != "" && !strings.EqualFold(pin.Identity, identity) {
+			continue
+		} else if pin.Quality != "" && !strings.EqualFold(pin.Quality, quality) {
+			continue
+		}
+
+		if pin.Group == "" {
+			if fallback == nil {
+				fallback = &i.Pins[n]
+			}
+		} else if i.InGroup(pin.Group, client) {
+			return pin.Commit, true
+		}
+	}
+
+	if fallback != nil {
+		return fallback.Commit, true
+	}
+	return "", false
+}
+
+// PinnedCommits returns every commit pinned for the platform and quality.
+func (i Installers) PinnedCommits(identity, quality string) []string {
+	var commits []string
+	for _, pin := range i.Pins {
+		if pin.Identity != "" && !strings.EqualFold(pin.Identity, identity) {
+			continue
+		} else if pin.Quality != "" && !strings.EqualFold(pin.Quality, quality) {
+			continue
+		}
+		commits = append(commits, pin.Commit)
+	}
+	return commits
+}
+
+// InGroup reports whether the client address is one of the group's addresses
+// or falls in one of its CIDR ranges.
+func (i Installers) InGroup(group string, client netip.Addr) bool {
+	if !client.IsValid() {
+		return false
+	}
+	client = client.Unmap()
+
+	for _, member := range i.Groups[group] {
+		if prefix, err := netip.ParsePrefix(member); err == nil {
+			if prefix.Contains(client) {
+				return true
+			}
+		} else if addr, err := netip.ParseAddr(member); err == nil {
+			if addr.Unmap() == client {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// IsRemote reports whether identity is one of the server or cli builds that
+// follow the client commits.
+func (i Installers) IsRemote(identity string) bool {
+	return slices.ContainsFunc(i.Remote, func(remote string) bool {
+		return strings.EqualFold(remote, identity)
+	})
+}
@@ -0,0 +1,74 @@
+package config
+
+import (
+	"time"
+
+	"github.com/wandel/vscmirror/common"
+	"github.com/wandel/vscmirror/marketplace"
+)
+
+// Retention decides which versions of a mirrored extension are kept, the
+// latest version is always kept.
+type Retention struct {
+	// Versions is how many of the newest versions of each extension are kept.
+	Versions int `json:"versions"`
+	// Since keeps every version updated after this time.
+	Since time.Time `json:"since"`
+	// Pinned are "publisher.name@version" entries that are always kept.
+	Pinned []string `json:"pinned"`
+	// Engines are the vscode versions the fleet runs, the newest version of
+	// each extension compatible with each of them is kept.
+	Engines []string `json:"engines"`
+}
+
+// AllVersions reports whether more than the latest version is needed.
+func (r Retention) AllVersions() bool {
+	return r.Versions > 1 || !r.Since.IsZero() || len(r.Pinned) > 0 || len(r.Engines) > 0
+}
+
+// IsPinned reports whether the version of the extension is on the pin list.
+func (r Retention) IsPinned(identity string, version string) bool {
+	return common.ContainsFold(r.Pinned, identity+"@"+version)
+}
+
+// Retain returns the versions to keep. The versions are expected newest first,
+// every target platform build of a kept version is kept. Stable and
+// pre-release versions are counted separately so the newest of each is kept.
+func (r Retention) Retain(extension marketplace.Extension) []marketplace.ExtensionVersion {
+	identity := extension.Identity()
+	keep := max(r.Versions, 1)
+
+	// the newest version of each kind compatible with each engine
+	compatible := []string{}
+	for _, engine := range r.Engines {
+		found := map[bool]bool{}
+		for _, version := range extension.Versions {
+			kind := version.IsPreRelease()
+			if !found[kind] && version.SupportsEngine(engine) {
+				found[kind] = true
+				compatible = append(compatible, version.Version)
+			}
+		}
+	}
+
+	var results []marketplace.ExtensionVersion
+	seen := map[bool][]string{}
+	for _, version := range extension.Versions {
+		kind := version.IsPreRelease()
+		if !common.ContainsFold(seen[kind], version.Version) {
+			seen[kind] = append(seen[kind], version.Version)
+		}
+
+		if len(seen[kind]) <= keep {
+			results = append(results, version)
+		} else if !r.Since.IsZero() && version.LastUpdated.After(r.Since) {
+			results = append(results, version)
+		} else if r.IsPinned(identity, version.Version) {
+			results = append(results, version)
+		} else if common.ContainsFold(compatible, version.Version) {
+			results = append(results, version)
+		}
+	}
+
+	return results
+}
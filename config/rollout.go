@@ -0,0 +1,70 @@
+package config
+
+import (
+	"hash/fnv"
+	"time"
+
+	"github.com/wandel/vscmirror/common"
+)
+
+// Rollout staggers new vscode builds over the clients. Each client is placed
+// in a fixed bucket from its identifier, so the same clients update first
+// every time and a client never flips back and forth during a rollout.
+type Rollout struct {
+	// Stages offer a build to Percent of the clients once it has been in the
+	// mirror for After. Without stages every build is offered immediately.
+	Stages []Stage `json:"stages"`
+	// Halted lists commits whose rollout is stopped, clients that have not
+	// updated yet keep being offered the previous build.
+	Halted []string `json:"halted"`
+	// Header identifies clients by a request header instead of their address.
+	Header string `json:"header"`
+}
+
+type Stage struct {
+	After   Duration `json:"after"`
+	Percent float64  `json:"percent"`
+}
+
+// Percent returns the share of clients a build that has been mirrored for age
+// is offered to.
+func (r Rollout) Percent(age time.Duration) float64 {
+	if len(r.Stages) == 0 {
+		return 100
+	}
+
+	percent := 0.0
+	for _, stage := range r.Stages {
+		if age >= time.Duration(stage.After) {
+			percent = max(percent, stage.Percent)
+		}
+	}
+	return percent
+}
+
+// IsHalted reports whether the rollout of commit has been stopped.
+func (r Rollout) IsHalted(commit string) bool {
+	return common.ContainsFold(r.Halted, commit)
+}
+
+// Complete reports whether commit, mirrored for age, is offered to everyone.
+func (r Rollout) Complete(commit string, age time.Duration) bool {
+	return !r.IsHalted(commit) && r.Percent(age) >= 100
+}
+
+// Offered reports whether the rollout of commit, mirrored for age, has reached
+// the client.
+func (r Rollout) Offered(client, commit string, age time.Duration) bool {
+	if r.IsHalted(commit) {
+		return false
+	}
+
+	percent := r.Percent(age)
+	if percent >= 100 {
+		return true
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(client))
+	return float64(hash.Sum32()%10000) < percent*100
+}
@@ -0,0 +1,98 @@
+package config
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+var testRollout = Rollout{
+	Stages: []Stage{
+		{After: Duration(time.Hour), Percent: 10},
+		{After: Duration(24 * time.Hour), Percent: 50},
+		{After: Duration(72 * time.Hour), Percent: 100},
+	},
+	Halted: []string{"BAD"},
+}
+
+func TestRolloutPercent(t *testing.T) {
+	tests := []struct {
+		rollout Rollout
+		age     time.Duration
+		want    float64
+	}{
+		{Rollout{}, 0, 100},
+		{testRollout, 0, 0},
+		{testRollout, time.Hour, 10},
+		{testRollout, 30 * time.Hour, 50},
+		{testRollout, 72 * time.Hour, 100},
+		{testRollout, 1000 * time.Hour, 100},
+	}
+
+	for _, test := range tests {
+		if got := test.rollout.Percent(test.age); got != test.want {
+			t.Errorf("Percent(%s) with %d stages = %v, want %v", test.age, len(test.rollout.Stages), got, test.want)
+		}
+	}
+}
+
+func TestRolloutComplete(t *testing.T) {
+	tests := []struct {
+		commit string
+		age    time.Duration
+		want   bool
+	}{
+		{"good", 30 * time.Hour, false},
+		{"good", 72 * time.Hour, true},
+		{"bad", 72 * time.Hour, false}, // halted commits match regardless of case
+	}
+
+	for _, test := range tests {
+		if got := testRollout.Complete(test.commit, test.age); got != test.want {
+			t.Errorf("Complete(%q, %s) = %v, want %v", test.commit, test.age, got, test.want)
+		}
+	}
+}
+
+func TestRolloutOffered(t *testing.T) {
+	clients := make([]string, 10000)
+	for n := range clients {
+		clients[n] = fmt.Sprintf("10.0.%d.%d", n/256, n%256)
+	}
+
+	offered := func(age time.Duration, commit string) map[string]bool {
+		results := map[string]bool{}
+		for _, client := range clients {
+			if testRollout.Offered(client, commit, age) {
+				results[client] = true
+			}
+		}
+		return results
+	}
+
+	early, later := offered(time.Hour, "good"), offered(30*time.Hour, "good")
+	if share := float64(len(early)) / float64(len(clients)); share < 0.08 || share > 0.12 {
+		t.Errorf("offered to %.1f%% of clients at 10%%", share*100)
+	}
+	if share := float64(len(later)) / float64(len(clients)); share < 0.45 || share > 0.55 {
+		t.Errorf("offered to %.1f%% of clients at 50%%", share*100)
+	}
+
+	// the clients a build reached keep getting it as the rollout widens
+	for client := range early {
+		if !later[client] {
+			t.Errorf("client %s dropped out of the rollout", client)
+			break
+		}
+	}
+
+	if n := len(offered(0, "good")); n != 0 {
+		t.Errorf("offered to %d clients before the first stage", n)
+	}
+	if n := len(offered(72*time.Hour, "good")); n != len(clients) {
+		t.Errorf("offered to %d of %d clients once complete", n, len(clients))
+	}
+	if n := len(offered(72*time.Hour, "bad")); n != 0 {
+		t.Errorf("offered a halted build to %d clients", n)
+	}
+}
@@ -0,0 +1,135 @@
+package config
+
+import (
+	"slices"
+
+	"github.com/wandel/vscmirror/common"
+	"github.com/wandel/vscmirror/marketplace"
+)
+
+// Selection decides which extensions are mirrored. An extension is selected if
+// it matches any of the Include rules (or Include is empty), matches none of the
+// Exclude rules and passes the MinInstalls and VerifiedOnly requirements.
+type Selection struct {
+	Include Rules `json:"include"`
+	Exclude Rules `json:"exclude"`
+	// MinInstalls is the minimum install count an extension needs.
+	MinInstalls float64 `json:"minInstalls"`
+	// VerifiedOnly limits the mirror to extensions from verified publishers.
+	VerifiedOnly bool `json:"verifiedOnly"`
+	// Platforms are the target platforms (win32-x64, linux-arm64, ...) whose
+	// platform specific builds are mirrored, universal builds are always
+	// mirrored. Empty mirrors every platform.
+	Platforms []string `json:"platforms"`
+	// PreRelease controls which extensions have their pre-release versions
+	// mirrored, by default only stable versions are.
+	PreRelease PreRelease `json:"preRelease"`
+}
+
+type PreRelease struct {
+	// All mirrors the pre-release versions of every extension.
+	All bool `json:"all"`
+	// Include and Exclude override All for these "publisher.name" extensions.
+	Include []string `json:"include"`
+	Exclude []string `json:"exclude"`
+}
+
+// Wanted reports whether pre-release versions of the extension are mirrored.
+func (p PreRelease) Wanted(identity string) bool {
+	if common.ContainsFold(p.Exclude, identity) {
+		return false
+	} else if common.ContainsFold(p.Include, identity) {
+		return true
+	}
+
+	return p.All
+}
+
+type Rules struct {
+	// Extensions are "publisher.name" identifiers.
+	Extensions []string `json:"extensions"`
+	Publishers []string `json:"publishers"`
+	Categories []string `json:"categories"`
+	Tags       []string `json:"tags"`
+}
+
+func (r Rules) Empty() bool {
+	return len(r.Extensions) == 0 && len(r.Publishers) == 0 && len(r.Categories) == 0 && len(r.Tags) == 0
+}
+
+// Explicit returns the "publisher.name" identifiers the rules are limited to,
+// false when they also match by publisher, category or tag.
+func (r Rules) Explicit() ([]string, bool) {
+	if len(r.Extensions) == 0 || len(r.Publishers) > 0 || len(r.Categories) > 0 || len(r.Tags) > 0 {
+		return nil, false
+	}
+	return r.Extensions, true
+}
+
+// Matches reports whether the extension satisfies any of the rules.
+func (r Rules) Matches(extension marketplace.Extension) bool {
+	if common.ContainsFold(r.Extensions, extension.Identity()) {
+		return true
+	} else if common.ContainsFold(r.Publishers, extension.Publisher.PublisherName) {
+		return true
+	}
+
+	for _, category := range extension.Categories {
+		if common.ContainsFold(r.Categories, category) {
+			return true
+		}
+	}
+
+	for _, tag := range extension.Tags {
+		if common.ContainsFold(r.Tags, tag) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s Selection) Selected(extension marketplace.Extension) bool {
+	if !s.Include.Empty() && !s.Include.Matches(extension) {
+		return false
+	} else if s.Exclude.Matches(extension) {
+		return false
+	} else if extension.GetStatistic("install") < s.MinInstalls {
+		return false
+	} else if s.VerifiedOnly && !IsVerified(extension.Publisher) {
+		return false
+	}
+
+	return true
+}
+
+// Versions returns the versions of the extension built for the selected
+// target platforms, without pre-release versions unless they are wanted.
+func (s Selection) Versions(extension marketplace.Extension) []marketplace.ExtensionVersion {
+	preRelease := s.PreRelease.Wanted(extension.Identity())
+	return slices.DeleteFunc(slices.Clone(extension.Versions), func(version marketplace.ExtensionVersion) bool {
+		if !s.PlatformSelected(version) {
+			return true
+		}
+		return version.IsPreRelease() && !preRelease
+	})
+}
+
+// PlatformSelected reports whether the version is built for a selected
+// target platform.
+func (s Selection) PlatformSelected(version marketplace.ExtensionVersion) bool {
+	if len(s.Platforms) == 0 || version.IsUniversal() {
+		return true
+	}
+
+	return common.ContainsFold(s.Platforms, version.TargetPlatform)
+}
+
+// IsVerified reports whether the marketplace shows the publisher as verified.
+func IsVerified(publisher marketplace.Publisher) bool {
+	if publisher.IsDomainVerified {
+		return true
+	}
+
+	return publisher.GetFlags()&marketplace.PublisherFlagsVerified != 0
+}
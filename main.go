@@ -9,9 +9,12 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/urfave/cli/v3"
 
+	"github.com/wandel/vscmirror/config"
 	"github.com/wandel/vscmirror/marketplace"
 	"github.com/wandel/vscmirror/server"
 	"github.com/wandel/vscmirror/sync"
@@ -21,11 +24,84 @@ func main() {
 	app := cli.Command{
 		Name:  "vsmarket",
 		Usage: "A marketplace for Visual Studio Code extensions",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "config",
+				Usage:   "path to the mirror configuration file",
+				Value:   "vscmirror.json",
+				Sources: cli.EnvVars("VSCMIRROR_CONFIG"),
+			},
+			&cli.StringFlag{
+				Name:    "root",
+				Usage:   "directory the mirrored artifacts are stored in",
+				Sources: cli.EnvVars("VSCMIRROR_ROOT"),
+			},
+			&cli.StringFlag{
+				Name:    "base-url",
+				Usage:   "public url clients reach the mirror on",
+				Sources: cli.EnvVars("VSCMIRROR_BASE_URL"),
+			},
+			&cli.StringFlag{
+				Name:    "gallery",
+				Usage:   "base url of the upstream extension gallery",
+				Sources: cli.EnvVars("VSCMIRROR_GALLERY"),
+			},
+		},
 		Commands: []*cli.Command{
 			&cli.Command{
 				Name:   "download",
 				Usage:  "download all extension data",
 				Action: DownloadAction,
+				Flags: []cli.Flag{
+					&cli.IntFlag{
+						Name:    "workers",
+						Usage:   "number of concurrent downloads",
+						Sources: cli.EnvVars("VSCMIRROR_WORKERS"),
+					},
+					&cli.IntFlag{
+						Name:    "bandwidth",
+						Usage:   "maximum download speed in bytes per second, 0 for unlimited",
+						Sources: cli.EnvVars("VSCMIRROR_BANDWIDTH"),
+					},
+					&cli.FloatFlag{
+						Name:    "rate",
+						Usage:   "maximum requests per second to the marketplace cdn and update server, 0 for unlimited",
+						Sources: cli.EnvVars("VSCMIRROR_RATE"),
+					},
+					&cli.StringSliceFlag{
+						Name:    "quality",
+						Usage:   "vscode release channels to mirror",
+						Sources: cli.EnvVars("VSCMIRROR_QUALITY"),
+					},
+					&cli.StringSliceFlag{
+						Name:  "extension",
+						Usage: "mirror the extension with this 'publisher.name' id",
+					},
+					&cli.StringSliceFlag{
+						Name:  "publisher",
+						Usage: "mirror every extension from this publisher",
+					},
+					&cli.StringSliceFlag{
+						Name:  "category",
+						Usage: "mirror every extension in this category",
+					},
+					&cli.StringSliceFlag{
+						Name:  "tag",
+						Usage: "mirror every extension with this tag",
+					},
+					&cli.StringSliceFlag{
+						Name:  "exclude",
+						Usage: "never mirror the extension with this 'publisher.name' id",
+					},
+					&cli.FloatFlag{
+						Name:  "min-installs",
+						Usage: "only mirror extensions with at least this many installs",
+					},
+					&cli.BoolFlag{
+						Name:  "verified-only",
+						Usage: "only mirror extensions from verified publishers",
+					},
+				},
 				Before: func(ctx context.Context, c *cli.Command) (context.Context, error) {
 					tmp, _ := signal.NotifyContext(ctx, os.Interrupt)
 					return tmp, nil
@@ -37,8 +113,46 @@ func main() {
 				Action: ServeAction,
 				Flags: []cli.Flag{
 					&cli.StringFlag{
-						Name:  "address",
-						Value: "127.0.0.1:443",
+						Name:    "address",
+						Sources: cli.EnvVars("VSCMIRROR_ADDRESS"),
+					},
+					&cli.StringFlag{
+						Name:    "cert",
+						Usage:   "tls certificate file",
+						Sources: cli.EnvVars("VSCMIRROR_TLS_CERT"),
+					},
+					&cli.StringFlag{
+						Name:    "key",
+						Usage:   "tls private key file",
+						Sources: cli.EnvVars("VSCMIRROR_TLS_KEY"),
+					},
+					&cli.DurationFlag{
+						Name:    "reload-interval",
+						Usage:   "how often to check the artifact root for a finished download, 0 to disable (SIGHUP still reloads)",
+						Sources: cli.EnvVars("VSCMIRROR_RELOAD_INTERVAL"),
+					},
+				},
+			},
+			&cli.Command{
+				Name:   "prune",
+				Usage:  "remove artifacts that are no longer referenced, only listing them unless --delete is given",
+				Action: PruneAction,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "delete",
+						Usage: "actually delete the orphaned files instead of doing a dry run",
+					},
+				},
+			},
+			&cli.Command{
+				Name:   "verify",
+				Usage:  "check the artifact store for missing, corrupt or extra files",
+				Action: VerifyAction,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "output",
+						Usage: "file to write the json report to, '-' for stdout",
+						Value: "-",
 					},
 				},
 			},
@@ -104,47 +218,236 @@ func main() {
 	}
 }
 
+// LoadConfig reads the configuration file and applies any flag or environment
+// overrides on top of it.
+func LoadConfig(cmd *cli.Command) (config.Config, error) {
+	cfg, err := config.Load(cmd.String("config"), cmd.IsSet("config"))
+	if err != nil {
+		return cfg, fmt.Errorf("failed to load config: %w", err)
+	}
+
+	if cmd.IsSet("root") {
+		cfg.Root = cmd.String("root")
+	}
+	if cmd.IsSet("base-url") {
+		cfg.BaseUrl = cmd.String("base-url")
+	}
+	if cmd.IsSet("gallery") {
+		cfg.Upstream.Gallery = cmd.String("gallery")
+	}
+
+	return cfg, nil
+}
+
 func DownloadAction(ctx context.Context, cmd *cli.Command) error {
-	if err := sync.DownloadInstallers(ctx); err != nil {
-		return fmt.Errorf("failed to download malicious extensions: %w", err)
+	cfg, err := LoadConfig(cmd)
+	if err != nil {
+		return err
+	}
+
+	if cmd.IsSet("workers") {
+		cfg.Download.Workers = int(cmd.Int("workers"))
+	}
+	if cmd.IsSet("bandwidth") {
+		cfg.Download.BytesPerSecond = int64(cmd.Int("bandwidth"))
+	}
+	if cmd.IsSet("rate") {
+		cfg.Download.RequestsPerSecond = cmd.Float("rate")
+	}
+	if cmd.IsSet("quality") {
+		cfg.Installers.Qualities = cmd.StringSlice("quality")
+	}
+	if cmd.IsSet("extension") {
+		cfg.Selection.Include.Extensions = cmd.StringSlice("extension")
+	}
+	if cmd.IsSet("publisher") {
+		cfg.Selection.Include.Publishers = cmd.StringSlice("publisher")
+	}
+	if cmd.IsSet("category") {
+		cfg.Selection.Include.Categories = cmd.StringSlice("category")
+	}
+	if cmd.IsSet("tag") {
+		cfg.Selection.Include.Tags = cmd.StringSlice("tag")
+	}
+	if cmd.IsSet("exclude") {
+		cfg.Selection.Exclude.Extensions = cmd.StringSlice("exclude")
+	}
+	if cmd.IsSet("min-installs") {
+		cfg.Selection.MinInstalls = cmd.Float("min-installs")
+	}
+	if cmd.IsSet("verified-only") {
+		cfg.Selection.VerifiedOnly = cmd.Bool("verified-only")
+	}
+	sync.Configure(cfg)
+
+	downloader := &sync.Downloader{
+		HttpClient:        http.DefaultClient,
+		Workers:           cfg.Download.Workers,
+		BytesPerSecond:    cfg.Download.BytesPerSecond,
+		RequestsPerSecond: cfg.Download.RequestsPerSecond,
+	}
+
+	if err := sync.DownloadInstallers(ctx, downloader); err != nil {
+		return fmt.Errorf("failed to download installers: %w", err)
 	}
 
 	// if err := sync.DownloadRecomendations(ctx); err != nil {
 	// 	return fmt.Errorf("failed to download malicious extensions: %w", err)
 	// }
 
-	if err := sync.DownloadMalicious(ctx); err != nil {
+	if err := sync.DownloadMalicious(ctx, downloader); err != nil {
 		return fmt.Errorf("failed to download malicious extensions: %w", err)
 	}
 
-	if err := sync.DownloadExtensions(ctx); err != nil {
-		return fmt.Errorf("failed to download malicious extensions: %w", err)
+	client := NewGalleryClient(cfg)
+
+	if err := sync.DownloadFeatured(ctx, client); err != nil {
+		return fmt.Errorf("failed to download featured extensions: %w", err)
+	}
+
+	if err := sync.DownloadExtensions(ctx, client, downloader); err != nil {
+		return fmt.Errorf("failed to download extensions: %w", err)
 	}
 
 	return nil
 }
 
 func ServeAction(ctx context.Context, cmd *cli.Command) error {
-	address := cmd.String("address")
-	slog.Info("listening", "address", address)
+	cfg, err := LoadServeConfig(cmd)
+	if err != nil {
+		return err
+	}
+	server.Configure(cfg)
 
-	var extensions []marketplace.Extension
-	if err := server.LoadExtensions(&extensions); err != nil {
-		return fmt.Errorf("failed to load extensions: %w", err)
+	if err := server.Reload(); err != nil {
+		return err
 	}
 
+	// pick up new downloads without a restart
+	go server.Watch(ctx, time.Duration(cfg.ReloadInterval))
+
+	// SIGHUP re-reads the configuration, e.g. to halt a rollout
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	defer signal.Stop(reload)
+	go func() {
+		for range reload {
+			slog.Info("reloading configuration")
+			cfg, err := LoadServeConfig(cmd)
+			if err != nil {
+				slog.Error("failed to reload configuration", "error", err)
+				continue
+			}
+
+			if err := server.Reconfigure(cfg); err != nil {
+				slog.Error("failed to reload extensions", "error", err)
+			}
+		}
+	}()
+
+	slog.Info("listening", "address", cfg.Address, "root", cfg.Root)
+
 	mux := server.NewServeMux()
-	return http.ListenAndServeTLS(address, "visualstudio.com.crt", "visualstudio.com.key", mux)
+	return http.ListenAndServeTLS(cfg.Address, cfg.Tls.Certificate, cfg.Tls.Key, mux)
+}
+
+// NewGalleryClient returns a client for the upstream gallery of cfg.
+func NewGalleryClient(cfg config.Config) *marketplace.Client {
+	return &marketplace.Client{
+		HttpClient: http.DefaultClient,
+		Version:    cfg.Upstream.Version,
+		BaseUrl:    cfg.Upstream.Gallery,
+		MaxRetries: cfg.Upstream.MaxRetries,
+		MinBackoff: time.Duration(cfg.Upstream.MinBackoff),
+		MaxBackoff: time.Duration(cfg.Upstream.MaxBackoff),
+	}
+}
+
+// LoadServeConfig reads the configuration with the serve flags applied on top.
+func LoadServeConfig(cmd *cli.Command) (config.Config, error) {
+	cfg, err := LoadConfig(cmd)
+	if err != nil {
+		return cfg, err
+	}
+
+	if cmd.IsSet("address") {
+		cfg.Address = cmd.String("address")
+	}
+	if cmd.IsSet("cert") {
+		cfg.Tls.Certificate = cmd.String("cert")
+	}
+	if cmd.IsSet("key") {
+		cfg.Tls.Key = cmd.String("key")
+	}
+	if cmd.IsSet("reload-interval") {
+		cfg.ReloadInterval = config.Duration(cmd.Duration("reload-interval"))
+	}
+
+	return cfg, nil
+}
+
+func PruneAction(ctx context.Context, cmd *cli.Command) error {
+	cfg, err := LoadConfig(cmd)
+	if err != nil {
+		return err
+	}
+	sync.Configure(cfg)
+
+	dryRun := !cmd.Bool("delete")
+	report, err := sync.Prune(dryRun)
+	if err != nil {
+		return fmt.Errorf("failed to prune artifacts: %w", err)
+	}
+
+	slog.Info("pruned artifacts", "files", len(report.Files), "directories", len(report.Directories), "bytes", report.Bytes, "dryRun", dryRun)
+	return nil
+}
+
+func VerifyAction(ctx context.Context, cmd *cli.Command) error {
+	cfg, err := LoadConfig(cmd)
+	if err != nil {
+		return err
+	}
+	sync.Configure(cfg)
+
+	report, err := sync.Verify()
+	if err != nil {
+		return fmt.Errorf("failed to verify artifacts: %w", err)
+	}
+
+	out := os.Stdout
+	if output := cmd.String("output"); output != "-" {
+		f, err := os.Create(output)
+		if err != nil {
+			return fmt.Errorf("failed to create '%s': %w", output, err)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		return fmt.Errorf("failed to encode report: %w", err)
+	}
+
+	if !report.Ok() {
+		return fmt.Errorf("artifact store has %d missing, %d corrupt and %d extra files", len(report.Missing), len(report.Corrupt), len(report.Extra))
+	}
+
+	return nil
 }
 
 func SearchAction(ctx context.Context, cmd *cli.Command) error {
 	fmt.Println("Searching the marketplace...")
 
-	client := marketplace.Client{
-		HttpClient: http.DefaultClient,
-		Version:    "1.99.1",
+	cfg, err := LoadConfig(cmd)
+	if err != nil {
+		return err
 	}
 
+	client := NewGalleryClient(cfg)
+
 	criteria := []marketplace.FilterCriteria{}
 	ids := cmd.StringSlice("id")
 	for _, id := range ids {
@@ -217,19 +520,7 @@ func SearchAction(ctx context.Context, cmd *cli.Command) error {
 		return fmt.Errorf("failed to query marketplace: %w", err)
 	}
 
-	total := 0
-	for _, metadata := range response.ResultMetadata {
-		if metadata.MetadataType != "ResultCount" {
-			continue
-		}
-
-		for _, item := range metadata.MetadataItems {
-			if item.Name == "TotalCount" {
-				total = item.Count
-			}
-		}
-	}
-	slog.Info("search completed", "results", len(response.Extensions), "total", total)
+	slog.Info("search completed", "results", len(response.Extensions), "total", response.TotalCount())
 
 	f, err := os.Create("search.json")
 	if err != nil {
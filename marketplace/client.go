@@ -6,18 +6,93 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"iter"
 	"log/slog"
 	"net/http"
+	"slices"
+	"strings"
+	"time"
 )
 
+// MaxPageSize is the largest pageSize the marketplace will honor.
+const MaxPageSize = 1000
+
+// CATEGORIES are the vscode marketplace categories, used to split large queries
+// into smaller ones.
+var CATEGORIES = []string{
+	"AI",
+	"Azure",
+	"Chat",
+	"Data Science",
+	"Debuggers",
+	"Education",
+	"Extension Packs",
+	"Formatters",
+	"Keymaps",
+	"Language Packs",
+	"Linters",
+	"Machine Learning",
+	"Notebooks",
+	"Programming Languages",
+	"SCM Providers",
+	"Snippets",
+	"Testing",
+	"Themes",
+	"Visualization",
+	"Other",
+}
+
+const (
+	DefaultBaseUrl = "https://marketplace.visualstudio.com/_apis/public/gallery"
+	DefaultUserId  = "469d6fbf-fa8f-48f0-a3f9-3157bce2494b"
+)
+
+var ErrNotFound = errors.New("not found")
+
 type Client struct {
 	HttpClient *http.Client
 	Version    string
+	// BaseUrl is the root of the gallery api, which lets the client talk to
+	// another vscmirror or an Open VSX instance. Empty uses DefaultBaseUrl.
+	BaseUrl string
+	// UserId is sent as x-market-user-id, empty uses DefaultUserId.
+	UserId string
+	// ClientId is sent as x-market-client-id, empty uses "VSCode {Version}".
+	ClientId string
+	// Headers are added to every request, overriding the defaults.
+	Headers http.Header
+	// MaxRetries is how many times a throttled or failed query is retried,
+	// zero uses DefaultMaxRetries and a negative value disables retrying.
+	MaxRetries int
+	// MinBackoff and MaxBackoff bound the delay between retries, zero uses
+	// DefaultMinBackoff and DefaultMaxBackoff.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
 }
 
+// GenericQuery sends the query to the marketplace, retrying on throttling,
+// server errors and network failures with a jittered exponential backoff.
 func (c *Client) GenericQuery(ctx context.Context, req QueryRequest) (QueryResponse, error) {
-	url := "https://marketplace.visualstudio.com/_apis/public/gallery/extensionquery"
+	retries := c.maxRetries()
+	for attempt := 0; ; attempt++ {
+		response, err := c.query(ctx, req)
+		if err == nil {
+			return response, nil
+		} else if attempt >= retries || !retryable(ctx, err) {
+			return response, err
+		}
+
+		delay := c.backoff(attempt, err)
+		slog.Warn("marketplace query failed, retrying", "attempt", attempt+1, "delay", delay, "error", err)
+		if err := sleep(ctx, delay); err != nil {
+			return response, err
+		}
+	}
+}
+
+func (c *Client) query(ctx context.Context, req QueryRequest) (QueryResponse, error) {
+	url := c.baseUrl() + "/extensionquery"
 
 	var response QueryResponse
 	var body bytes.Buffer
@@ -34,23 +109,36 @@ func (c *Client) GenericQuery(ctx context.Context, req QueryRequest) (QueryRespo
 	request.Header.Set("Content-Type", "application/json")
 	request.Header.Set("Accept", "application/json;api-version=3.0-preview.1")
 	request.Header.Set("User-Agent", "VSCode "+c.Version+" (Code)")
-	request.Header.Set("x-market-client-id", "VSCode "+c.Version)
-	request.Header.Set("x-market-user-id", "469d6fbf-fa8f-48f0-a3f9-3157bce2494b")
-	slog.Info("sending request")
+	request.Header.Set("x-market-client-id", c.clientId())
+	request.Header.Set("x-market-user-id", c.userId())
+	for key, values := range c.Headers {
+		request.Header.Del(key)
+		for _, value := range values {
+			request.Header.Add(key, value)
+		}
+	}
 	resp, err := c.HttpClient.Do(request)
 	if err != nil {
-		return response, fmt.Errorf("failed to send request to '%s': %w", url, err)
+		return response, &networkError{fmt.Errorf("failed to send request to '%s': %w", url, err)}
 	}
 	defer resp.Body.Close()
-	slog.Info("processing response")
 
-	slog.Info("search", "status", resp.StatusCode, "url", url)
+	slog.Debug("search", "status", resp.StatusCode, "url", url)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		snippet, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return response, &StatusError{
+			Url:        url,
+			StatusCode: resp.StatusCode,
+			Body:       string(snippet),
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+	}
 
 	wrapper := struct {
 		Results []QueryResponse `json:"results"`
 	}{}
 	if err := json.NewDecoder(resp.Body).Decode(&wrapper); err != nil {
-		return response, fmt.Errorf("failed to decode response from '%s': %w", url, err)
+		return response, &networkError{fmt.Errorf("failed to decode response from '%s': %w", url, err)}
 	}
 
 	if len(wrapper.Results) == 0 {
@@ -60,15 +148,55 @@ func (c *Client) GenericQuery(ctx context.Context, req QueryRequest) (QueryRespo
 	return wrapper.Results[0], nil
 }
 
+func (c *Client) baseUrl() string {
+	if c.BaseUrl == "" {
+		return DefaultBaseUrl
+	}
+	return strings.TrimSuffix(c.BaseUrl, "/")
+}
+
+func (c *Client) userId() string {
+	if c.UserId == "" {
+		return DefaultUserId
+	}
+	return c.UserId
+}
+
+func (c *Client) clientId() string {
+	if c.ClientId == "" {
+		return "VSCode " + c.Version
+	}
+	return c.ClientId
+}
+
 func (c *Client) GetLastestExtensionVersion(ctx context.Context, ids []string) ([]Extension, error) {
 	return nil, errors.New("not implemented yet")
 }
 
+// GetExtensionsByName returns the latest version of the extensions with the
+// given "publisher.name" identifiers. Unknown names are silently skipped.
 func (c *Client) GetExtensionsByName(ctx context.Context, names []string) ([]Extension, error) {
+	return c.getExtensionsByName(ctx, names, true)
+}
+
+// GetExtensionVersions returns the extension with every published version,
+// newest first.
+func (c *Client) GetExtensionVersions(ctx context.Context, name string) (Extension, error) {
+	extensions, err := c.getExtensionsByName(ctx, []string{name}, false)
+	if err != nil {
+		return Extension{}, err
+	} else if len(extensions) == 0 {
+		return Extension{}, fmt.Errorf("extension '%s': %w", name, ErrNotFound)
+	}
+
+	return extensions[0], nil
+}
+
+func (c *Client) getExtensionsByName(ctx context.Context, names []string, latestOnly bool) ([]Extension, error) {
 	criteria := []FilterCriteria{}
 	for _, id := range names {
 		criteria = append(criteria, FilterCriteria{
-			FilterType: FilterTypeExtensionName,
+			FilterType: FilterTypeName,
 			Value:      id,
 		})
 	}
@@ -85,7 +213,9 @@ func (c *Client) GetExtensionsByName(ctx context.Context, names []string) ([]Ext
 	flags |= QueryFlagExcludeNonValidated
 	flags |= QueryFlagIncludeAssetUri
 	flags |= QueryFlagIncludeStatistics
-	flags |= QueryFlagIncludeLatestVersionOnly
+	if latestOnly {
+		flags |= QueryFlagIncludeLatestVersionOnly
+	}
 
 	request := QueryRequest{
 		Flags:      flags,
@@ -109,14 +239,11 @@ func (c *Client) GetExtensionsByName(ctx context.Context, names []string) ([]Ext
 	return response.Extensions, nil
 }
 
-func (c *Client) GetExtensionsPaged(ctx context.Context, pageSize int, pageNumber int) ([]Extension, error) {
-	criteria := []FilterCriteria{
-		FilterCriteria{
-			FilterType: FilterTypeInstallationTarget,
-			Value:      "Microsoft.VisualStudio.Code",
-		},
-	}
+func (c *Client) GetExtensionsPaged(ctx context.Context, criteria []FilterCriteria, sortBy SortBy, pageSize int, pageNumber int) (QueryResponse, error) {
+	return c.getExtensionsPaged(ctx, criteria, sortBy, SortOrderDescending, pageSize, pageNumber)
+}
 
+func (c *Client) getExtensionsPaged(ctx context.Context, criteria []FilterCriteria, sortBy SortBy, sortOrder SortOrder, pageSize int, pageNumber int) (QueryResponse, error) {
 	var flags QueryFlag
 	flags |= QueryFlagIncludeFiles
 	flags |= QueryFlagIncludeCategoryAndTags
@@ -132,8 +259,8 @@ func (c *Client) GetExtensionsPaged(ctx context.Context, pageSize int, pageNumbe
 		Filters: []QueryFilter{
 			QueryFilter{
 				Criteria:   criteria,
-				SortBy:     SortByInstallCount,
-				SortOrder:  SortOrderDescending,
+				SortBy:     sortBy,
+				SortOrder:  sortOrder,
 				PageSize:   pageSize,
 				PageNumber: pageNumber,
 			},
@@ -142,32 +269,165 @@ func (c *Client) GetExtensionsPaged(ctx context.Context, pageSize int, pageNumbe
 
 	response, err := c.GenericQuery(ctx, request)
 	if err != nil {
-		return nil, fmt.Errorf("failed to query extensions by text: %w", err)
+		return response, fmt.Errorf("failed to query page %d of extensions: %w", pageNumber, err)
 	}
 
-	return response.Extensions, nil
+	return response, nil
 }
 
-func (c *Client) GetAllExtensions(ctx context.Context) iter.Seq[Extension] {
-	return func(yield func(Extension) bool) {
-		current := 1
-		for {
-			select {
-			case <-ctx.Done():
+// GetExtensions pages through every extension matching the criteria, stopping
+// once a short page is returned or the reported TotalCount has been reached.
+func (c *Client) GetExtensions(ctx context.Context, criteria []FilterCriteria, sortBy SortBy) iter.Seq2[Extension, error] {
+	return func(yield func(Extension, error) bool) {
+		for response, err := range c.getPages(ctx, criteria, sortBy, SortOrderDescending) {
+			if err != nil {
+				yield(Extension{}, err)
 				return
-			default:
 			}
 
-			extensions, err := c.GetExtensionsPaged(ctx, 1000, current)
+			for _, extension := range response.Extensions {
+				if !yield(extension, nil) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// getPages returns the pages GetExtensions goes through.
+func (c *Client) getPages(ctx context.Context, criteria []FilterCriteria, sortBy SortBy, sortOrder SortOrder) iter.Seq2[QueryResponse, error] {
+	return func(yield func(QueryResponse, error) bool) {
+		seen := 0
+		for current := 1; ; current++ {
+			if err := ctx.Err(); err != nil {
+				yield(QueryResponse{}, err)
+				return
+			}
+
+			response, err := c.getExtensionsPaged(ctx, criteria, sortBy, sortOrder, MaxPageSize, current)
 			if err != nil {
-				slog.Error("failed to get page of extensions", "page", current, "error", err)
+				yield(response, err)
+				return
+			} else if !yield(response, nil) {
+				return
 			}
 
-			for _, extension := range extensions {
-				if !yield(extension) {
+			seen += len(response.Extensions)
+			if len(response.Extensions) < MaxPageSize || seen >= response.TotalCount() {
+				return
+			}
+		}
+	}
+}
+
+// GetUpdatedExtensions returns the extensions that have been updated since the
+// given time, most recently updated first.
+func (c *Client) GetUpdatedExtensions(ctx context.Context, since time.Time) iter.Seq2[Extension, error] {
+	criteria := []FilterCriteria{
+		FilterCriteria{
+			FilterType: FilterTypeInstallationTarget,
+			Value:      "Microsoft.VisualStudio.Code",
+		},
+	}
+
+	return func(yield func(Extension, error) bool) {
+		for extension, err := range c.GetExtensions(ctx, criteria, SortByLastUpdatedDate) {
+			if err != nil {
+				yield(extension, err)
+				return
+			} else if extension.LastUpdated.Before(since) {
+				return // everything after this is older too
+			} else if !yield(extension, nil) {
+				return
+			}
+		}
+	}
+}
+
+// GetAllExtensions returns every vscode extension in the marketplace. The
+// marketplace caps how many results a single query can page through, so if the
+// unfiltered query comes up short the catalog is re-queried one category at a
+// time, and categories that are still too large are paged through from both
+// ends. Extensions are de-duplicated by ExtensionId across the shards.
+func (c *Client) GetAllExtensions(ctx context.Context) iter.Seq2[Extension, error] {
+	criteria := []FilterCriteria{
+		FilterCriteria{
+			FilterType: FilterTypeInstallationTarget,
+			Value:      "Microsoft.VisualStudio.Code",
+		},
+	}
+
+	return func(yield func(Extension, error) bool) {
+		probe, err := c.GetExtensionsPaged(ctx, criteria, SortByInstallCount, 1, 1)
+		if err != nil {
+			yield(Extension{}, fmt.Errorf("failed to get total extension count: %w", err))
+			return
+		}
+		total := probe.TotalCount()
+
+		seen := map[string]bool{}
+		// drain yields the extensions of the shard that weren't seen before,
+		// recording every one it found. It returns how many the shard holds
+		// and false once the caller stopped.
+		drain := func(shard []FilterCriteria, order SortOrder, found map[string]bool) (int, bool) {
+			count := 0
+			for response, err := range c.getPages(ctx, shard, SortByInstallCount, order) {
+				if err != nil {
+					return count, yield(Extension{}, err)
+				}
+
+				count = response.TotalCount()
+				for _, extension := range response.Extensions {
+					found[extension.ExtensionId] = true
+					if seen[extension.ExtensionId] {
+						continue
+					}
+
+					seen[extension.ExtensionId] = true
+					if !yield(extension, nil) {
+						return count, false
+					}
+				}
+			}
+			return count, true
+		}
+
+		if _, ok := drain(criteria, SortOrderDescending, map[string]bool{}); !ok {
+			return
+		}
+
+		if len(seen) < total {
+			slog.Debug("extension query incomplete, sharding by category", "seen", len(seen), "total", total)
+		}
+
+		for _, category := range CATEGORIES {
+			if len(seen) >= total || ctx.Err() != nil {
+				return
+			}
+
+			shard := append(slices.Clone(criteria), FilterCriteria{
+				FilterType: FilterTypeCategory,
+				Value:      category,
+			})
+
+			found := map[string]bool{}
+			count, ok := drain(shard, SortOrderDescending, found)
+			if !ok {
+				return
+			} else if len(found) < count {
+				// the ascending pass reaches the extensions the cap cut off
+				if _, ok := drain(shard, SortOrderAscending, found); !ok {
 					return
 				}
 			}
+
+			if len(found) < count {
+				slog.Warn("category has more extensions than the marketplace pages through", "category", category, "found", len(found), "total", count)
+			}
+		}
+
+		if len(seen) < total && ctx.Err() == nil {
+			slog.Warn("the marketplace listed fewer extensions than it reported, the mirror is incomplete", "seen", len(seen), "total", total)
 		}
 	}
 }
@@ -0,0 +1,165 @@
+package marketplace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testGallery serves total extensions from /extensionquery, a page at a time,
+// spread round robin over the categories except for the last uncategorized
+// ones. Like the marketplace it stops paging after limit results when set.
+// fail can answer a request with an error status instead, it is passed the
+// number of the request starting at 1.
+type testGallery struct {
+	total         int
+	limit         int
+	uncategorized int
+	fail          func(n int, w http.ResponseWriter) bool
+	requests      atomic.Int32
+}
+
+func (g *testGallery) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n := int(g.requests.Add(1))
+	if g.fail != nil && g.fail(n, w) {
+		return
+	}
+
+	var request QueryRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	filter := request.Filters[0]
+	var matches []Extension
+	for i := range g.total {
+		extension := Extension{ExtensionId: fmt.Sprintf("extension-%d", i)}
+		if i < g.total-g.uncategorized {
+			extension.Categories = []string{CATEGORIES[i%len(CATEGORIES)]}
+		}
+		if filter.Matches(extension, nil) {
+			matches = append(matches, extension)
+		}
+	}
+	if filter.SortOrder == SortOrderAscending {
+		slices.Reverse(matches)
+	}
+
+	end := len(matches)
+	if g.limit > 0 {
+		end = min(end, g.limit)
+	}
+
+	var response QueryResponse
+	start := min((filter.PageNumber-1)*filter.PageSize, end)
+	response.Extensions = matches[start:min(start+filter.PageSize, end)]
+	response.ResultMetadata = []QueryResultMetadata{{
+		MetadataType:  "ResultCount",
+		MetadataItems: []MetadataItem{{Name: "TotalCount", Count: len(matches)}},
+	}}
+
+	json.NewEncoder(w).Encode(map[string]any{"results": []QueryResponse{response}})
+}
+
+func newTestClient(t *testing.T, gallery *testGallery) *Client {
+	server := httptest.NewServer(gallery)
+	t.Cleanup(server.Close)
+
+	return &Client{
+		HttpClient: server.Client(),
+		BaseUrl:    server.URL,
+		MinBackoff: time.Millisecond,
+		MaxBackoff: time.Millisecond,
+	}
+}
+
+func TestGetExtensionsPages(t *testing.T) {
+	gallery := &testGallery{total: 2*MaxPageSize + 500}
+	client := newTestClient(t, gallery)
+
+	seen := map[string]bool{}
+	for extension, err := range client.GetExtensions(context.Background(), nil, SortByInstallCount) {
+		if err != nil {
+			t.Fatalf("failed to get extensions: %v", err)
+		}
+		seen[extension.ExtensionId] = true
+	}
+
+	if len(seen) != gallery.total {
+		t.Errorf("got %d extensions, want %d", len(seen), gallery.total)
+	}
+	if n := gallery.requests.Load(); n != 3 {
+		t.Errorf("sent %d requests, want 3", n)
+	}
+}
+
+func TestGetAllExtensionsShards(t *testing.T) {
+	gallery := &testGallery{total: 4 * MaxPageSize, limit: MaxPageSize}
+	client := newTestClient(t, gallery)
+
+	seen := map[string]bool{}
+	for extension, err := range client.GetAllExtensions(context.Background()) {
+		if err != nil {
+			t.Fatalf("failed to get extensions: %v", err)
+		} else if seen[extension.ExtensionId] {
+			t.Errorf("got %s twice", extension.ExtensionId)
+		}
+		seen[extension.ExtensionId] = true
+	}
+
+	if len(seen) != gallery.total {
+		t.Errorf("got %d extensions, want %d", len(seen), gallery.total)
+	}
+}
+
+func TestGetAllExtensionsLargeCategories(t *testing.T) {
+	// every category holds more than the marketplace pages through
+	gallery := &testGallery{total: 21 * MaxPageSize, limit: MaxPageSize}
+	client := newTestClient(t, gallery)
+
+	seen := map[string]bool{}
+	for extension, err := range client.GetAllExtensions(context.Background()) {
+		if err != nil {
+			t.Fatalf("failed to get extensions: %v", err)
+		}
+		seen[extension.ExtensionId] = true
+	}
+
+	if len(seen) != gallery.total {
+		t.Errorf("got %d extensions, want %d", len(seen), gallery.total)
+	}
+}
+
+func TestGetAllExtensionsIncomplete(t *testing.T) {
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+
+	gallery := &testGallery{total: 2 * MaxPageSize, limit: MaxPageSize, uncategorized: 100}
+	client := newTestClient(t, gallery)
+
+	seen := map[string]bool{}
+	for extension, err := range client.GetAllExtensions(context.Background()) {
+		if err != nil {
+			t.Fatalf("failed to get extensions: %v", err)
+		}
+		seen[extension.ExtensionId] = true
+	}
+
+	if want := gallery.total - gallery.uncategorized; len(seen) != want {
+		t.Errorf("got %d extensions, want %d", len(seen), want)
+	}
+	if !strings.Contains(logs.String(), "the mirror is incomplete") {
+		t.Errorf("missing extensions were not reported: %s", logs.String())
+	}
+}
@@ -0,0 +1,208 @@
+package marketplace
+
+import (
+	"cmp"
+	"strconv"
+	"strings"
+)
+
+const PropertyEngine = "Microsoft.VisualStudio.Code.Engine"
+
+// Engine returns the vscode version range the version requires, e.g. "^1.85.0".
+func (v ExtensionVersion) Engine() string {
+	return v.GetProperty(PropertyEngine)
+}
+
+// SupportsEngine reports whether the version can be installed on the given
+// vscode version. Versions without an engine property are assumed compatible.
+func (v ExtensionVersion) SupportsEngine(version string) bool {
+	engine, ok := ParseEngine(v.Engine())
+	target, valid := ParseVersion(version)
+	if !ok || !valid {
+		return true
+	}
+
+	return engine.Contains(target)
+}
+
+// Version is a major.minor.patch vscode version, pre-release suffixes such as
+// "-insider" are ignored.
+type Version [3]int
+
+func ParseVersion(value string) (Version, bool) {
+	var version Version
+	value, _, _ = strings.Cut(strings.TrimSpace(value), "-")
+	parts := strings.Split(value, ".")
+	if len(parts) == 0 || len(parts) > 3 {
+		return version, false
+	}
+
+	for i, part := range parts {
+		if part == "x" || part == "X" || part == "*" {
+			continue
+		}
+
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return version, false
+		}
+		version[i] = n
+	}
+
+	return version, true
+}
+
+func (v Version) Compare(other Version) int {
+	for i := range v {
+		if c := cmp.Compare(v[i], other[i]); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// next returns the first version after v with a larger part n.
+func (v Version) next(n int) Version {
+	var next Version
+	copy(next[:n], v[:n])
+	next[n] = v[n] + 1
+	return next
+}
+
+// ParseVersionRange parses the "low-high" value of an installation target
+// version range. Both versions may carry a pre-release suffix such as
+// "-insider", so the range is split at the first dash that leaves two valid
+// versions.
+func ParseVersionRange(value string) (Version, Version, bool) {
+	for n, c := range value {
+		if c != '-' {
+			continue
+		}
+
+		low, lowValid := ParseVersion(value[:n])
+		high, highValid := ParseVersion(value[n+1:])
+		if lowValid && highValid {
+			return low, high, true
+		}
+	}
+
+	return Version{}, Version{}, false
+}
+
+// EngineRange is the half open range [Min, Max) of vscode versions an
+// extension supports, Max is unbounded when Open is set.
+type EngineRange struct {
+	Min  Version
+	Max  Version
+	Open bool
+}
+
+// ParseEngine parses an engines.vscode value with the rules vscode validates
+// it by: "*" allows anything, "1.2.3" only that version, "^1.2.3" anything up
+// to the next major version (the next minor version for 0.x) and ">=1.2.3"
+// anything from that version on. An "x" part frees the parts after it as well
+// and pre-release suffixes are ignored. Like vscode, every 1.x release accepts
+// a 0.x range that isn't an exact version.
+//
+// vscode considers ">", "<", "<=" and "~" invalid, they are given their semver
+// meaning instead of hiding the extension.
+func ParseEngine(value string) (EngineRange, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" || value == "*" {
+		return EngineRange{Open: true}, true
+	}
+
+	operator := ""
+	for _, prefix := range []string{">=", "<=", ">", "<", "^", "~"} {
+		if rest, ok := strings.CutPrefix(value, prefix); ok {
+			operator, value = prefix, strings.TrimSpace(rest)
+			break
+		}
+	}
+
+	version, fixed, valid := parseEngineVersion(value)
+	if !valid {
+		return EngineRange{}, false
+	}
+
+	switch operator {
+	case ">=":
+		return EngineRange{Min: version, Open: true}, true
+	case ">":
+		return EngineRange{Min: version.next(2), Open: true}, true
+	case "<":
+		return EngineRange{Max: version}, true
+	case "<=":
+		return EngineRange{Max: version.next(2)}, true
+	case "~":
+		return EngineRange{Min: version, Max: version.next(1)}, true
+	case "^":
+		if version[0] == 0 {
+			fixed = min(fixed, 2)
+		} else {
+			fixed = min(fixed, 1)
+		}
+	}
+
+	var engine EngineRange
+	switch fixed {
+	case 0:
+		engine = EngineRange{Min: version, Open: true}
+	case 3:
+		engine = EngineRange{Min: version, Max: version.next(2)}
+	default:
+		engine = EngineRange{Min: version, Max: version.next(fixed - 1)}
+	}
+
+	// a 0.x range always ends before 2.0.0, stretch it over the 1.x releases
+	if version[0] == 0 && fixed < 3 && !engine.Open {
+		engine.Max = Version{2, 0, 0}
+	}
+	return engine, true
+}
+
+// parseEngineVersion parses the major.minor.patch version of an engine range,
+// returning how many leading parts are fixed before the first "x".
+func parseEngineVersion(value string) (Version, int, bool) {
+	var version Version
+	value, _, _ = strings.Cut(value, "-")
+	parts := strings.Split(value, ".")
+	if len(parts) != 3 {
+		return version, 0, false
+	}
+
+	fixed := len(parts)
+	for i, part := range parts {
+		if part == "x" {
+			fixed = min(fixed, i)
+			continue
+		}
+
+		if part == "" || strings.Trim(part, "0123456789") != "" {
+			return version, 0, false
+		}
+
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return version, 0, false
+		}
+		version[i] = n
+	}
+
+	return version, fixed, true
+}
+
+func (r EngineRange) Contains(version Version) bool {
+	if version.Compare(r.Min) < 0 {
+		return false
+	}
+	return r.Open || version.Compare(r.Max) < 0
+}
+
+// Overlaps reports whether any version in [low, high] is in the range.
+func (r EngineRange) Overlaps(low, high Version) bool {
+	if high.Compare(r.Min) < 0 {
+		return false
+	}
+	return r.Open || low.Compare(r.Max) < 0
+}
@@ -0,0 +1,89 @@
+package marketplace
+
+import "testing"
+
+func TestParseEngine(t *testing.T) {
+	tests := []struct {
+		engine  string
+		version string
+		want    bool
+	}{
+		{"*", "1.90.0", true},
+		{"", "1.90.0", true},
+		{"^1.85.0", "1.85.0", true},
+		{"^1.85.0", "1.99.1", true},
+		{"^1.85.0", "1.84.2", false},
+		{"^1.85.0", "2.0.0", false},
+		{"^1.85.0", "1.90.0-insider", true},
+		{"1.85.0", "1.85.0", true},
+		{"1.85.0", "1.85.1", false},
+		{"1.85.0", "1.86.0", false},
+		{"1.85.x", "1.85.3", true},
+		{"1.85.x", "1.86.0", false},
+		{"1.x.x", "1.99.0", true},
+		{"x.x.x", "2.0.0", true},
+		{"^1.x.x", "1.0.0", true},
+		{">=1.85.0", "1.85.0", true},
+		{">=1.85.0", "2.1.0", true},
+		{">=1.85.0", "1.84.0", false},
+		{"^0.10.0", "0.10.5", true},
+		{"^0.10.0", "1.90.0", true},
+		{"^0.10.0", "2.0.0", false},
+		{"0.10.0", "1.90.0", false},
+		{"^1.85.0-20240101", "1.85.0", true},
+		{" ^1.85.0 ", "1.85.0", true},
+		{">1.85.0", "1.85.0", false},
+		{">1.85.0", "1.85.1", true},
+		{"<1.85.0", "1.84.9", true},
+		{"<1.85.0", "1.85.0", false},
+		{"<=1.85.0", "1.85.0", true},
+		{"~1.85.0", "1.85.9", true},
+		{"~1.85.0", "1.86.0", false},
+	}
+
+	for _, test := range tests {
+		engine, ok := ParseEngine(test.engine)
+		if !ok {
+			t.Errorf("ParseEngine(%q) failed", test.engine)
+			continue
+		}
+
+		version, valid := ParseVersion(test.version)
+		if !valid {
+			t.Fatalf("ParseVersion(%q) failed", test.version)
+		}
+
+		if got := engine.Contains(version); got != test.want {
+			t.Errorf("ParseEngine(%q).Contains(%q) = %v, want %v", test.engine, test.version, got, test.want)
+		}
+	}
+}
+
+func TestParseEngineInvalid(t *testing.T) {
+	for _, engine := range []string{"1.85", "^1", "latest", "1.85.0.1", "^1.x5.0", "1.-1.0"} {
+		if _, ok := ParseEngine(engine); ok {
+			t.Errorf("ParseEngine(%q) succeeded", engine)
+		}
+	}
+}
+
+func TestParseVersionRange(t *testing.T) {
+	tests := []struct {
+		value string
+		low   Version
+		high  Version
+		ok    bool
+	}{
+		{"1.80.0-1.90.0", Version{1, 80, 0}, Version{1, 90, 0}, true},
+		{"1.80.0-insider-1.90.0", Version{1, 80, 0}, Version{1, 90, 0}, true},
+		{"1.80.0-1.90.0-insider", Version{1, 80, 0}, Version{1, 90, 0}, true},
+		{"1.80.0", Version{}, Version{}, false},
+	}
+
+	for _, test := range tests {
+		low, high, ok := ParseVersionRange(test.value)
+		if ok != test.ok || low != test.low || high != test.high {
+			t.Errorf("ParseVersionRange(%q) = %v, %v, %v, want %v, %v, %v", test.value, low, high, ok, test.low, test.high, test.ok)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package marketplace
 
 import (
+	"slices"
 	"strings"
 	"time"
 )
@@ -20,10 +21,45 @@ type Extension struct {
 	Tags             []string             `json:"tags"`
 	Statistics       []ExtensionStatistic `json:"statistics"`
 	DeploymentType   int                  `json:"deploymentType"`
+	// InstallationTargets is only returned with QueryFlagIncludeInstallationTargets.
+	InstallationTargets []InstallationTarget `json:"installationTargets,omitempty"`
 	// This is in the vscodeoffline code, but I haven't seen it from the vscode marketplace yet
 	// Recommended      bool                 `json:"recommended"`
 }
 
+// Identity returns the "publisher.name" identifier vscode uses for the extension.
+func (e Extension) Identity() string {
+	return e.Publisher.PublisherName + "." + e.ExtensionName
+}
+
+// Clone returns a copy of the extension that shares no slices with the
+// original, so its versions and files can be modified freely.
+func (e Extension) Clone() Extension {
+	e.Categories = slices.Clone(e.Categories)
+	e.Tags = slices.Clone(e.Tags)
+	e.Statistics = slices.Clone(e.Statistics)
+	e.InstallationTargets = slices.Clone(e.InstallationTargets)
+	e.Versions = slices.Clone(e.Versions)
+	for i, version := range e.Versions {
+		e.Versions[i].Files = slices.Clone(version.Files)
+		e.Versions[i].Properties = slices.Clone(version.Properties)
+	}
+	return e
+}
+
+// HasInstallationTarget reports whether the extension can be installed into
+// target. Without installation targets in the metadata the extension is
+// assumed to be a vscode extension, as those are the only ones mirrored.
+func (e Extension) HasInstallationTarget(target string) bool {
+	if len(e.InstallationTargets) == 0 {
+		return strings.EqualFold(target, InstallationTargetVSCode)
+	}
+
+	return slices.ContainsFunc(e.InstallationTargets, func(installation InstallationTarget) bool {
+		return strings.EqualFold(installation.Target, target)
+	})
+}
+
 func (e Extension) GetStatistic(name string) float64 {
 	name = strings.ToLower(name)
 	for _, stat := range e.Statistics {
@@ -35,6 +71,8 @@ func (e Extension) GetStatistic(name string) float64 {
 	return 0
 }
 
+const TargetPlatformUniversal = "universal"
+
 type Publisher struct {
 	PublisherId      string `json:"publisherId"`
 	PublisherName    string `json:"publisherName"`
@@ -44,6 +82,11 @@ type Publisher struct {
 	IsDomainVerified bool   `json:"isDomainVerified"`
 }
 
+type InstallationTarget struct {
+	Target        string `json:"target"`
+	TargetVersion string `json:"targetVersion"`
+}
+
 type ExtensionStatistic struct {
 	StatisticName string  `json:"statisticName"`
 	Value         float64 `json:"value"`
@@ -60,6 +103,56 @@ type ExtensionVersion struct {
 	FallbackAssetURI string              `json:"fallbackAssetUri"`
 }
 
+// IsUniversal reports whether the version runs on every platform.
+func (v ExtensionVersion) IsUniversal() bool {
+	return v.TargetPlatform == "" || strings.EqualFold(v.TargetPlatform, TargetPlatformUniversal)
+}
+
+// IsPreRelease reports whether the version was published as a pre-release.
+func (v ExtensionVersion) IsPreRelease() bool {
+	return strings.EqualFold(v.GetProperty(PropertyPreRelease), "true")
+}
+
+// platform returns the lowercase target platform, with universal builds
+// normalised to "universal".
+func (v ExtensionVersion) platform() string {
+	if v.IsUniversal() {
+		return TargetPlatformUniversal
+	}
+	return strings.ToLower(v.TargetPlatform)
+}
+
+const (
+	PropertyExtensionDependencies = "Microsoft.VisualStudio.Code.ExtensionDependencies"
+	PropertyExtensionPack         = "Microsoft.VisualStudio.Code.ExtensionPack"
+	PropertyPreRelease            = "Microsoft.VisualStudio.Code.PreRelease"
+)
+
+func (v ExtensionVersion) GetProperty(key string) string {
+	for _, property := range v.Properties {
+		if strings.EqualFold(property.Key, key) {
+			return property.Value
+		}
+	}
+
+	return ""
+}
+
+// Dependencies returns the "publisher.name" identifiers of the extensions this
+// version depends on or bundles as an extension pack.
+func (v ExtensionVersion) Dependencies() []string {
+	var dependencies []string
+	for _, key := range []string{PropertyExtensionDependencies, PropertyExtensionPack} {
+		for _, value := range strings.Split(v.GetProperty(key), ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				dependencies = append(dependencies, value)
+			}
+		}
+	}
+
+	return dependencies
+}
+
 type ExtensionProperty struct {
 	Key   string `json:"key"`
 	Value string `json:"value"`
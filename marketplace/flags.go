@@ -0,0 +1,66 @@
+package marketplace
+
+import (
+	"strconv"
+	"strings"
+)
+
+var extensionFlagNames = map[string]PublishedExtensionFlags{
+	"none":         PublishedExtensionFlagsNone,
+	"disabled":     PublishedExtensionFlagsDisabled,
+	"builtin":      PublishedExtensionFlagsBuiltIn,
+	"validated":    PublishedExtensionFlagsValidated,
+	"trusted":      PublishedExtensionFlagsTrusted,
+	"paid":         PublishedExtensionFlagsPaid,
+	"public":       PublishedExtensionFlagsPublic,
+	"multiversion": PublishedExtensionFlagsMultiVersion,
+	"system":       PublishedExtensionFlagsSystem,
+	"preview":      PublishedExtensionFlagsPreview,
+	"unpublished":  PublishedExtensionFlagsUnpublished,
+	"trial":        PublishedExtensionFlagsTrial,
+	"locked":       PublishedExtensionFlagsLocked,
+	"hidden":       PublishedExtensionFlagsHidden,
+}
+
+var publisherFlagNames = map[string]PublisherFlags{
+	"none":      PublisherFlagsNone,
+	"disabled":  PublisherFlagsDisabled,
+	"verified":  PublisherFlagsVerified,
+	"certified": PublisherFlagsCertified,
+}
+
+// ParseExtensionFlags parses the flags of an extension, which the marketplace
+// returns as a comma separated list of names like "validated, public". Plain
+// integers are accepted as well, unknown names are ignored.
+func ParseExtensionFlags(value string) PublishedExtensionFlags {
+	return parseFlags(value, extensionFlagNames)
+}
+
+// ParsePublisherFlags parses the flags of a publisher, e.g. "verified".
+func ParsePublisherFlags(value string) PublisherFlags {
+	return parseFlags(value, publisherFlagNames)
+}
+
+func parseFlags[T ~int](value string, names map[string]T) T {
+	var flags T
+	for _, name := range strings.Split(value, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if n, err := strconv.Atoi(name); err == nil {
+			flags |= T(n)
+		} else {
+			flags |= names[name]
+		}
+	}
+
+	return flags
+}
+
+// GetFlags returns the parsed flags of the extension.
+func (e Extension) GetFlags() PublishedExtensionFlags {
+	return ParseExtensionFlags(e.Flags)
+}
+
+// GetFlags returns the parsed flags of the publisher.
+func (p Publisher) GetFlags() PublisherFlags {
+	return ParsePublisherFlags(p.Flags)
+}
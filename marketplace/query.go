@@ -2,6 +2,7 @@ package marketplace
 
 import (
 	"log/slog"
+	"slices"
 	"strings"
 )
 
@@ -42,6 +43,8 @@ const (
 	QueryFlagIncludeSharedOrganizations QueryFlag = 16384
 	// Include the details if an extension is in conflict list or not Currently being used for VSCode extensions.
 	QueryFlagIncludeNameConflictInfo QueryFlag = 32768
+	// When retrieving versions from a query, only include the latest stable and the latest pre-release version of the extensions that matched. This is what vscode uses to offer switching to a pre-release version.
+	QueryFlagIncludeLatestPrereleaseAndStableVersionOnly QueryFlag = 65536
 	// AllAttributes is designed to be a mask that defines all sub-elements of the extension should be returned.  NOTE: This is not actually All flags. This is now locked to the set defined since changing this enum would be a breaking change and would change the behavior of anyone using it. Try not to use this value when making calls to the service, instead be explicit about the options required.
 	QueryFlagAllAttributes QueryFlag = 16863
 )
@@ -219,6 +222,24 @@ type QueryResponse struct {
 	ResultMetadata []QueryResultMetadata `json:"resultMetadata"`
 }
 
+// TotalCount returns the number of extensions the filter matched, as reported
+// in the ResultCount metadata.
+func (response QueryResponse) TotalCount() int {
+	for _, metadata := range response.ResultMetadata {
+		if metadata.MetadataType != "ResultCount" {
+			continue
+		}
+
+		for _, item := range metadata.MetadataItems {
+			if item.Name == "TotalCount" {
+				return item.Count
+			}
+		}
+	}
+
+	return 0
+}
+
 type QueryFilter struct {
 	// The filter values define the set of values in this query. They are applied based on the QueryFilterType.
 	Criteria []FilterCriteria `json:"criteria"`
@@ -236,76 +257,192 @@ type QueryFilter struct {
 	SortOrder SortOrder `json:"sortOrder"`
 }
 
-func (filter *QueryFilter) Matches(extension Extension) bool {
+// Matches evaluates the filter the way the marketplace does. Criteria of the
+// same type are OR'd and the different types are AND'd, with the identity
+// criteria (id, name, display name) counting as a single type, so asking for
+// several extensions by name returns each of them. Every category is AND'd on
+// its own and ExcludeWithFlags removes whatever the other criteria matched.
+// Criteria that do not apply to vscode extensions are ignored. Featured lists
+// the "publisher.name" of the extensions the mirror presents as featured, as
+// the extensions themselves don't record whether the marketplace features them.
+func (filter *QueryFilter) Matches(extension Extension, featured []string) bool {
+	groups := map[FilterType]bool{}
 	for _, criteria := range filter.Criteria {
-		if criteria.FilterType == FilterTypeExcludeWithFlags {
-			if criteria.Matches(extension) {
-				return false // exclude this extension
+		switch criteria.FilterType {
+		case FilterTypeExcludeWithFlags:
+			if criteria.Matches(extension, featured) {
+				return false
 			}
-		} else if criteria.FilterType == FilterTypeIncludeWithFlags {
-			if criteria.Matches(extension) {
-				return true
+			continue
+		case FilterTypeCategory:
+			if !criteria.Matches(extension, featured) {
+				return false
 			}
-		} else if criteria.Matches(extension) {
-			return true
+			continue
+		case FilterTypePrivate, FilterTypeLcid, FilterTypeOrganizationSharedWith, FilterTypeProductArchitecture:
+			continue
+		}
+
+		group := criteria.FilterType
+		if group.IsIdentity() {
+			group = FilterTypeName
 		}
+		groups[group] = groups[group] || criteria.Matches(extension, featured)
 	}
-	return false
-}
 
-func ShouldSkipFirstStageFilters(filter QueryFilter) bool {
-	for _, criteria := range filter.Criteria {
-		switch criteria.FilterType {
-		case FilterTypeExcludeWithFlags:
-			continue
-		case FilterTypeInstallationTarget:
-			continue
-		default:
+	for _, matched := range groups {
+		if !matched {
 			return false
 		}
 	}
 	return true
 }
 
-func (filter *QueryFilter) FilterFirstStage(extensions []Extension) []Extension {
-	var results []Extension
+// Filter returns the extensions that match the filter, in their original order.
+func (filter *QueryFilter) Filter(extensions []Extension, featured []string) []Extension {
+	results := []Extension{}
 	for _, extension := range extensions {
-		for _, criteria := range filter.Criteria {
-			switch criteria.FilterType {
-			case FilterTypeExcludeWithFlags:
-				continue
-			case FilterTypeInstallationTarget:
-				continue
-			default:
-			}
+		if filter.Matches(extension, featured) {
+			results = append(results, extension)
+		}
+	}
+	return results
+}
+
+// IsIdentity reports whether the filter type selects extensions by identity,
+// criteria of these types are OR'd with each other.
+func (t FilterType) IsIdentity() bool {
+	switch t {
+	case FilterTypeId, FilterTypeName, FilterTypeExtensionName, FilterTypeDisplayName:
+		return true
+	}
+	return false
+}
 
-			if criteria.Matches(extension) {
-				results = append(results, extension)
+// TargetPlatforms returns the platforms requested with FilterTypeTargetPlatform
+// criteria, or nil if the filter does not restrict the platform.
+func (filter *QueryFilter) TargetPlatforms() []string {
+	var platforms []string
+	for _, criteria := range filter.Criteria {
+		if criteria.FilterType == FilterTypeTargetPlatform {
+			platforms = append(platforms, criteria.Value)
+		}
+	}
+
+	return platforms
+}
+
+// FilterTargetPlatforms returns the versions built for one of the platforms,
+// universal builds are always kept.
+func FilterTargetPlatforms(versions []ExtensionVersion, platforms []string) []ExtensionVersion {
+	var results []ExtensionVersion
+	for _, version := range versions {
+		if version.IsUniversal() {
+			results = append(results, version)
+			continue
+		}
+
+		for _, platform := range platforms {
+			if strings.EqualFold(version.TargetPlatform, platform) {
+				results = append(results, version)
 				break
 			}
 		}
 	}
+
 	return results
 }
 
-func (filter *QueryFilter) FilterSecondStage(extensions []Extension) []Extension {
-	var results []Extension
-	for _, extension := range extensions {
-		for _, criteria := range filter.Criteria {
-			switch criteria.FilterType {
-			case FilterTypeExcludeWithFlags:
-			case FilterTypeInstallationTarget:
-			default:
-				continue
-			}
+// FilterEngineVersions returns the versions compatible with every
+// FilterTypeInstallationTargetVersion and FilterTypeInstallationTargetVersionRange
+// criteria of the filter.
+func (filter *QueryFilter) FilterEngineVersions(versions []ExtensionVersion) []ExtensionVersion {
+	var results []ExtensionVersion
+	for _, version := range versions {
+		if filter.supportsEngine(version) {
+			results = append(results, version)
+		}
+	}
 
-			if criteria.Matches(extension) {
-				results = append(results, extension)
-				break
+	return results
+}
+
+// HasEngineCriteria reports whether the filter restricts the vscode version.
+func (filter *QueryFilter) HasEngineCriteria() bool {
+	for _, criteria := range filter.Criteria {
+		switch criteria.FilterType {
+		case FilterTypeInstallationTargetVersion, FilterTypeInstallationTargetVersionRange:
+			return true
+		}
+	}
+
+	return false
+}
+
+func (filter *QueryFilter) supportsEngine(version ExtensionVersion) bool {
+	engine, ok := ParseEngine(version.Engine())
+	if !ok {
+		return true
+	}
+
+	for _, criteria := range filter.Criteria {
+		switch criteria.FilterType {
+		case FilterTypeInstallationTargetVersion:
+			if target, valid := ParseVersion(criteria.Value); valid && !engine.Contains(target) {
+				return false
+			}
+		case FilterTypeInstallationTargetVersionRange:
+			if low, high, valid := ParseVersionRange(criteria.Value); valid && !engine.Overlaps(low, high) {
+				return false
 			}
 		}
 	}
 
+	return true
+}
+
+// LatestVersions returns the newest stable version for each target platform,
+// falling back to the newest pre-release version for platforms without a
+// stable release. The versions are expected to be ordered newest first as the
+// marketplace does.
+func LatestVersions(versions []ExtensionVersion) []ExtensionVersion {
+	latest := LatestStableAndPreReleaseVersions(versions)
+
+	stable := map[string]bool{}
+	for _, version := range latest {
+		if !version.IsPreRelease() {
+			stable[version.platform()] = true
+		}
+	}
+
+	var results []ExtensionVersion
+	for _, version := range latest {
+		if version.IsPreRelease() && stable[version.platform()] {
+			continue
+		}
+		results = append(results, version)
+	}
+
+	return results
+}
+
+// LatestStableAndPreReleaseVersions returns the newest stable and the newest
+// pre-release version for each target platform.
+func LatestStableAndPreReleaseVersions(versions []ExtensionVersion) []ExtensionVersion {
+	var results []ExtensionVersion
+	seen := map[string]bool{}
+	for _, version := range versions {
+		key := version.platform()
+		if version.IsPreRelease() {
+			key += "@pre-release"
+		}
+
+		if !seen[key] {
+			seen[key] = true
+			results = append(results, version)
+		}
+	}
+
 	return results
 }
 
@@ -337,6 +474,38 @@ func (filter QueryFilter) Compare(a, b Extension) int {
 	}
 }
 
+// DefaultOrder is the order the marketplace sorts by s in when the query
+// doesn't ask for one, names are ascending and everything else descending.
+func (s SortBy) DefaultOrder() SortOrder {
+	switch s {
+	case SortByTitle, SortByPublisher, SortByAuthor:
+		return SortOrderAscending
+	case SortByRelevance, SortByLastUpdatedDate, SortByInstallCount, SortByPublishedDate,
+		SortByAverageRating, SortByTrendingDaily, SortByTrendingWeekly, SortByTrendingMonthly,
+		SortByReleaseDate, SortByWeightedRating:
+		return SortOrderDescending
+	default:
+		return SortOrderAscending
+	}
+}
+
+// Sort orders the extensions by the filter's SortBy and SortOrder, falling back
+// to the default order of SortBy. Extensions that compare equal keep their
+// relative order.
+func (filter QueryFilter) Sort(extensions []Extension) {
+	order := filter.SortOrder
+	if order == SortOrderDefault {
+		order = filter.SortBy.DefaultOrder()
+	}
+
+	slices.SortStableFunc(extensions, func(a, b Extension) int {
+		if order == SortOrderDescending {
+			return filter.Compare(b, a)
+		}
+		return filter.Compare(a, b)
+	})
+}
+
 func CompareStatistic(a, b Extension, name string) int {
 	s1 := a.GetStatistic(name)
 	s2 := b.GetStatistic(name)
@@ -353,56 +522,70 @@ type FilterCriteria struct {
 	Value      string     `json:"value"`
 }
 
-func (criteria *FilterCriteria) Matches(extension Extension) bool {
+// InstallationTargetVSCode is the installation target of vscode extensions.
+const InstallationTargetVSCode = "Microsoft.VisualStudio.Code"
+
+// Matches reports whether the extension satisfies the criteria on its own. For
+// FilterTypeExcludeWithFlags it reports whether the extension has one of the
+// flags, the caller is responsible for excluding it.
+func (criteria *FilterCriteria) Matches(extension Extension, featured []string) bool {
 	switch criteria.FilterType {
-	// case FilterTypeTag:
-	// 	return false // TODO: Implement tag filtering
+	case FilterTypeTag:
+		return containsFold(extension.Tags, criteria.Value)
 	case FilterTypeDisplayName:
 		return strings.EqualFold(extension.DisplayName, criteria.Value)
 	// case FilterTypePrivate:
 	// 	return false
 	case FilterTypeId:
 		return extension.ExtensionId == criteria.Value
-	// case FilterTypeCategory:
-	// 	return false // TODO: Implement category filtering
-	// case FilterTypeContributionType:
-	// 	return false
+	case FilterTypeCategory:
+		return containsFold(extension.Categories, criteria.Value)
+	case FilterTypeContributionType:
+		// vscode never sends this and the manifest contributions are not part
+		// of the query metadata. vsce tags extensions with what they contribute
+		// ("theme", "snippet", "keybindings", ...), so matching the tags is a
+		// best effort rather than what the marketplace does.
+		return containsFold(extension.Tags, criteria.Value)
 	case FilterTypeName:
 		tmp := extension.Publisher.PublisherName + "." + extension.ExtensionName
 		return strings.EqualFold(tmp, criteria.Value)
 	case FilterTypeInstallationTarget:
-		return true // TODO: Implement target filtering
-	// case FilterTypeFeatured:
-	// 	return false // TODO: Implement featured filtering
+		return extension.HasInstallationTarget(criteria.Value)
+	case FilterTypeFeatured:
+		return containsFold(featured, extension.Identity())
 	case FilterTypeSearchText:
 		return MatchSearchTextCriteria(extension, criteria.Value)
-	// case FilterTypeFeaturedInCategory:
-	// 	return false
+	case FilterTypeFeaturedInCategory:
+		return containsFold(featured, extension.Identity()) && containsFold(extension.Categories, criteria.Value)
 	case FilterTypeExcludeWithFlags:
 		// this is ususally used with the value "4096" which is "unpublished"
-		return true // TODO: Implement exclude with flags filtering
-	// case FilterTypeIncludeWithFlags:
-	// 	return false
+		return extension.GetFlags()&ParseExtensionFlags(criteria.Value) != 0
+	case FilterTypeIncludeWithFlags:
+		return extension.GetFlags()&ParseExtensionFlags(criteria.Value) != 0
 	// case FilterTypeLcid:
 	// 	return false
-	// case FilterTypeInstallationTargetVersion:
-	// 	return false
-	// case FilterTypeInstallationTargetVersionRange:
-	// 	return false
-	// case FilterTypeVsixMetadata:
-	// 	return false
+	case FilterTypeInstallationTargetVersion, FilterTypeInstallationTargetVersionRange:
+		return slices.ContainsFunc(extension.Versions, func(version ExtensionVersion) bool {
+			filter := QueryFilter{Criteria: []FilterCriteria{*criteria}}
+			return filter.supportsEngine(version)
+		})
+	case FilterTypeVsixMetadata:
+		return MatchVsixMetadataCriteria(extension, criteria.Value)
 	case FilterTypePublisherName:
 		return strings.EqualFold(extension.Publisher.PublisherName, criteria.Value)
 	case FilterTypePublisherDisplayName:
 		return strings.EqualFold(extension.Publisher.DisplayName, criteria.Value)
-	// case FilterTypeIncludeWithPublisherFlags:
-	// 	return false
+	case FilterTypeIncludeWithPublisherFlags:
+		return extension.Publisher.GetFlags()&ParsePublisherFlags(criteria.Value) != 0
 	// case FilterTypeOrganizationSharedWith:
 	// 	return false
 	// case FilterTypeProductArchitecture:
 	// 	return false
-	// case FilterTypeTargetPlatform:
-	// 	return false
+	case FilterTypeTargetPlatform:
+		// universal builds run on every platform
+		return slices.ContainsFunc(extension.Versions, func(version ExtensionVersion) bool {
+			return version.IsUniversal() || strings.EqualFold(version.TargetPlatform, criteria.Value)
+		})
 	case FilterTypeExtensionName:
 		return strings.EqualFold(extension.DisplayName, criteria.Value)
 	default:
@@ -411,6 +594,31 @@ func (criteria *FilterCriteria) Matches(extension Extension) bool {
 	}
 }
 
+// MatchVsixMetadataCriteria matches "key:value" against the properties of the
+// extension's versions, a bare key only requires the property to be set.
+func MatchVsixMetadataCriteria(extension Extension, text string) bool {
+	key, value, hasValue := strings.Cut(text, ":")
+	for _, version := range extension.Versions {
+		for _, property := range version.Properties {
+			if !strings.EqualFold(property.Key, strings.TrimSpace(key)) {
+				continue
+			} else if !hasValue || strings.EqualFold(property.Value, strings.TrimSpace(value)) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// containsFold is common.ContainsFold, which marketplace can't import as common
+// depends on it.
+func containsFold(values []string, value string) bool {
+	return slices.ContainsFunc(values, func(v string) bool {
+		return strings.EqualFold(v, value)
+	})
+}
+
 func MatchSearchTextCriteria(extension Extension, text string) bool {
 	if text == "*" {
 		return true
@@ -0,0 +1,75 @@
+package marketplace
+
+import (
+	"encoding/json"
+	"os"
+	"slices"
+	"testing"
+)
+
+// queryTest is a filter query vscode sends, trimmed down to a single filter,
+// and the identities of the test extensions it matches in the order they are
+// sorted in.
+type queryTest struct {
+	Name     string       `json:"name"`
+	Featured []string     `json:"featured"`
+	Request  QueryRequest `json:"request"`
+	Want     []string     `json:"want"`
+}
+
+// loadqueryTests reads the test extensions and queries the server tests share.
+func loadqueryTests(t *testing.T) ([]Extension, []queryTest) {
+	data, err := os.ReadFile("testdata/queries.json")
+	if err != nil {
+		t.Fatalf("failed to read queries: %v", err)
+	}
+
+	var queries struct {
+		Extensions []Extension `json:"extensions"`
+		Tests      []queryTest `json:"tests"`
+	}
+	if err := json.Unmarshal(data, &queries); err != nil {
+		t.Fatalf("failed to decode queries: %v", err)
+	}
+
+	return queries.Extensions, queries.Tests
+}
+
+func TestQueryFilterMatches(t *testing.T) {
+	extensions, tests := loadqueryTests(t)
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			filter := test.Request.Filters[0]
+			matches := filter.Filter(extensions, test.Featured)
+			filter.Sort(matches)
+
+			got := []string{}
+			for _, extension := range matches {
+				got = append(got, extension.Identity())
+			}
+
+			if !slices.Equal(got, test.Want) {
+				t.Errorf("got %v, want %v", got, test.Want)
+			}
+		})
+	}
+}
+
+func TestParseExtensionFlags(t *testing.T) {
+	tests := []struct {
+		value string
+		want  PublishedExtensionFlags
+	}{
+		{"", PublishedExtensionFlagsNone},
+		{"validated, public", PublishedExtensionFlagsValidated | PublishedExtensionFlagsPublic},
+		{"Validated,Public,Preview", PublishedExtensionFlagsValidated | PublishedExtensionFlagsPublic | PublishedExtensionFlagsPreview},
+		{"4096", PublishedExtensionFlagsUnpublished},
+		{"validated, unknown", PublishedExtensionFlagsValidated},
+	}
+
+	for _, test := range tests {
+		if got := ParseExtensionFlags(test.value); got != test.want {
+			t.Errorf("ParseExtensionFlags(%q) = %d, want %d", test.value, got, test.want)
+		}
+	}
+}
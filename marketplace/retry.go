@@ -0,0 +1,136 @@
+package marketplace
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	DefaultMaxRetries = 5
+	DefaultMinBackoff = time.Second
+	DefaultMaxBackoff = time.Minute
+)
+
+// StatusError is returned when the marketplace responds with a non-2xx status.
+type StatusError struct {
+	Url        string
+	StatusCode int
+	// Body holds the start of the response body, which usually explains the error.
+	Body string
+	// RetryAfter is the delay requested by the Retry-After header, if any.
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status code %d from '%s': %s", e.StatusCode, e.Url, e.Body)
+}
+
+// Temporary reports whether the request may succeed if retried.
+func (e *StatusError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// retryable reports whether err is worth retrying, which is the case for
+// throttling, server errors and network failures but not for cancellation.
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	var status *StatusError
+	if errors.As(err, &status) {
+		return status.Temporary()
+	}
+
+	var network *networkError
+	return errors.As(err, &network)
+}
+
+// networkError marks failures to send a request or read its response.
+type networkError struct {
+	err error
+}
+
+func (e *networkError) Error() string {
+	return e.err.Error()
+}
+
+func (e *networkError) Unwrap() error {
+	return e.err
+}
+
+// backoff returns a jittered exponential delay for the given attempt, or the
+// server requested delay if it asked for one. Neither exceeds MaxBackoff, so a
+// misbehaving server can't stall the sync.
+func (c *Client) backoff(attempt int, err error) time.Duration {
+	minimum, maximum := c.MinBackoff, c.MaxBackoff
+	if minimum <= 0 {
+		minimum = DefaultMinBackoff
+	}
+	if maximum <= 0 {
+		maximum = DefaultMaxBackoff
+	}
+
+	var status *StatusError
+	if errors.As(err, &status) && status.RetryAfter > 0 {
+		return min(status.RetryAfter, maximum)
+	}
+
+	// double step by step, shifting by attempt could overflow
+	delay := min(minimum, maximum)
+	for range attempt {
+		if delay >= maximum/2 {
+			delay = maximum
+			break
+		}
+		delay *= 2
+	}
+
+	// equal jitter keeps parallel clients from retrying in lockstep while
+	// still waiting at least half the delay
+	return delay/2 + rand.N(delay/2+1)
+}
+
+func (c *Client) maxRetries() int {
+	if c.MaxRetries < 0 {
+		return 0
+	} else if c.MaxRetries == 0 {
+		return DefaultMaxRetries
+	}
+	return c.MaxRetries
+}
+
+// parseRetryAfter handles both forms of the Retry-After header, delay-seconds
+// and an http date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if when, err := http.ParseTime(value); err == nil {
+		return max(time.Until(when), 0)
+	}
+
+	return 0
+}
+
+func sleep(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
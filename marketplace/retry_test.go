@@ -0,0 +1,102 @@
+package marketplace
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestGenericQueryRetries(t *testing.T) {
+	gallery := &testGallery{total: 1, fail: func(n int, w http.ResponseWriter) bool {
+		switch n {
+		case 1:
+			w.WriteHeader(http.StatusTooManyRequests)
+		case 2:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			return false
+		}
+		return true
+	}}
+	client := newTestClient(t, gallery)
+
+	response, err := client.GetExtensionsPaged(context.Background(), nil, SortByInstallCount, 1, 1)
+	if err != nil {
+		t.Fatalf("failed to query extensions: %v", err)
+	}
+
+	if len(response.Extensions) != 1 {
+		t.Errorf("got %d extensions, want 1", len(response.Extensions))
+	}
+	if n := gallery.requests.Load(); n != 3 {
+		t.Errorf("sent %d requests, want 3", n)
+	}
+}
+
+func TestGenericQueryClientError(t *testing.T) {
+	gallery := &testGallery{fail: func(n int, w http.ResponseWriter) bool {
+		http.Error(w, "bad filter", http.StatusBadRequest)
+		return true
+	}}
+	client := newTestClient(t, gallery)
+
+	_, err := client.GetExtensionsPaged(context.Background(), nil, SortByInstallCount, 1, 1)
+	var status *StatusError
+	if !errors.As(err, &status) || status.StatusCode != http.StatusBadRequest {
+		t.Fatalf("got %v, want a %d status error", err, http.StatusBadRequest)
+	}
+	if n := gallery.requests.Load(); n != 1 {
+		t.Errorf("sent %d requests, want 1", n)
+	}
+}
+
+func TestGenericQueryRetryAfter(t *testing.T) {
+	gallery := &testGallery{total: 1, fail: func(n int, w http.ResponseWriter) bool {
+		if n > 1 {
+			return false
+		}
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusTooManyRequests)
+		return true
+	}}
+	client := newTestClient(t, gallery)
+	client.MaxBackoff = time.Minute
+
+	start := time.Now()
+	if _, err := client.GetExtensionsPaged(context.Background(), nil, SortByInstallCount, 1, 1); err != nil {
+		t.Fatalf("failed to query extensions: %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("retried after %s, want at least the requested second", elapsed)
+	}
+}
+
+func TestBackoffRetryAfterLimit(t *testing.T) {
+	client := &Client{MinBackoff: time.Millisecond, MaxBackoff: time.Second}
+	err := &StatusError{StatusCode: http.StatusTooManyRequests, RetryAfter: 24 * time.Hour}
+
+	if delay := client.backoff(0, err); delay != time.Second {
+		t.Errorf("waiting %s for a day long Retry-After, want the %s limit", delay, client.MaxBackoff)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"120", 2 * time.Minute},
+		{"soon", 0},
+		{"Wed, 21 Oct 2015 07:28:00 GMT", 0}, // in the past
+	}
+
+	for _, test := range tests {
+		if got := parseRetryAfter(test.value); got != test.want {
+			t.Errorf("parseRetryAfter(%q) = %s, want %s", test.value, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wandel/vscmirror/common"
+	"github.com/wandel/vscmirror/marketplace"
+)
+
+// CATALOG holds the extensions the gallery handlers serve. It is replaced as a
+// whole on reload, requests that already loaded it keep using the old one.
+var CATALOG atomic.Pointer[Catalog]
+
+var reloadMu sync.Mutex
+var generation string
+
+// Current returns the catalog in use, an empty one before the first load.
+func Current() *Catalog {
+	if catalog := CATALOG.Load(); catalog != nil {
+		return catalog
+	}
+	return NewCatalog(nil, nil)
+}
+
+// Reload rebuilds the catalog from the artifact root and swaps it in. The
+// current catalog stays in use if loading fails.
+func Reload() error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	current, err := readGeneration()
+	if err != nil {
+		return err
+	}
+
+	catalog, err := LoadCatalog()
+	if err != nil {
+		return fmt.Errorf("failed to load extensions: %w", err)
+	}
+
+	CATALOG.Store(catalog)
+	generation = current
+	slog.Info("loaded extensions", "count", catalog.Len(), "generation", current)
+	return nil
+}
+
+// Watch reloads the catalog whenever the sync writes a new generation marker,
+// checking every interval. It returns once ctx is done.
+func Watch(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		current, err := readGeneration()
+		if err != nil {
+			slog.Error("failed to read generation marker", "error", err)
+			continue
+		}
+
+		reloadMu.Lock()
+		changed := current != generation
+		reloadMu.Unlock()
+		if !changed {
+			continue
+		}
+
+		slog.Info("artifact root changed, reloading extensions", "generation", current)
+		if err := Reload(); err != nil {
+			slog.Error("failed to reload extensions", "error", err)
+		}
+	}
+}
+
+// readGeneration returns the generation marker the sync last wrote, empty if
+// it never wrote one.
+func readGeneration() (string, error) {
+	data, err := fs.ReadFile(ARTIFACTS, common.GenerationFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("failed to read '%s': %w", common.GenerationFile, err)
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+// Catalog keeps the mirrored extensions in memory, indexed by the fields the
+// gallery queries look them up by. Index keys are lowercase. A catalog is never
+// modified once built, the extensions it returns share their versions with it
+// and must be cloned before they are changed.
+type Catalog struct {
+	extensions []marketplace.Extension
+	ids        map[string]int
+	names      map[string]int
+	publishers map[string][]int
+	categories map[string][]int
+	tags       map[string][]int
+	platforms  map[string][]int
+	featured   []string
+}
+
+// LoadCatalog builds a catalog from the extensions in the artifact root.
+func LoadCatalog() (*Catalog, error) {
+	var extensions []marketplace.Extension
+	if err := LoadExtensions(&extensions); err != nil {
+		return nil, err
+	}
+
+	featured := FEATURED
+	if len(featured) == 0 {
+		err := common.LoadJsonFS(ARTIFACTS, "extensions/featured.json", &featured)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("failed to load featured extensions: %w", err)
+		}
+	}
+
+	return NewCatalog(extensions, featured), nil
+}
+
+// NewCatalog indexes the extensions, featured lists the "publisher.name" of
+// those served for @featured.
+func NewCatalog(extensions []marketplace.Extension, featured []string) *Catalog {
+	catalog := &Catalog{
+		extensions: extensions,
+		ids:        map[string]int{},
+		names:      map[string]int{},
+		publishers: map[string][]int{},
+		categories: map[string][]int{},
+		tags:       map[string][]int{},
+		platforms:  map[string][]int{},
+		featured:   featured,
+	}
+
+	for n, extension := range extensions {
+		catalog.ids[strings.ToLower(extension.ExtensionId)] = n
+		catalog.names[strings.ToLower(extension.Identity())] = n
+		index(catalog.publishers, n, extension.Publisher.PublisherName)
+		index(catalog.categories, n, extension.Categories...)
+		index(catalog.tags, n, extension.Tags...)
+
+		for _, version := range extension.Versions {
+			platform := version.TargetPlatform
+			if version.IsUniversal() {
+				platform = marketplace.TargetPlatformUniversal
+			}
+			index(catalog.platforms, n, platform)
+		}
+	}
+
+	return catalog
+}
+
+// index adds n to the entries of keys, once per key.
+func index(entries map[string][]int, n int, keys ...string) {
+	for _, key := range keys {
+		key = strings.ToLower(key)
+		if values := entries[key]; len(values) == 0 || values[len(values)-1] != n {
+			entries[key] = append(values, n)
+		}
+	}
+}
+
+// Len returns the number of extensions in the catalog.
+func (c *Catalog) Len() int {
+	return len(c.extensions)
+}
+
+// Extensions returns every extension in the catalog.
+func (c *Catalog) Extensions() []marketplace.Extension {
+	return append([]marketplace.Extension{}, c.extensions...)
+}
+
+// Get returns the extension with the "publisher.name" identity.
+func (c *Catalog) Get(identity string) (marketplace.Extension, bool) {
+	n, ok := c.names[strings.ToLower(identity)]
+	if !ok {
+		return marketplace.Extension{}, false
+	}
+	return c.extensions[n], true
+}
+
+// entry returns the index entry of key as a list, empty if there is none.
+func entry(entries map[string]int, key string) []int {
+	if n, ok := entries[key]; ok {
+		return []int{n}
+	}
+	return nil
+}
+
+func (c *Catalog) lookup(entries []int) []marketplace.Extension {
+	results := make([]marketplace.Extension, 0, len(entries))
+	for _, n := range entries {
+		results = append(results, c.extensions[n])
+	}
+	return results
+}
+
+// Filter returns the extensions in the catalog that match the filter.
+func (c *Catalog) Filter(filter marketplace.QueryFilter) []marketplace.Extension {
+	return filter.Filter(c.Candidates(filter), c.featured)
+}
+
+// Candidates narrows the catalog down to the extensions the filter could match
+// using the indexes. Criteria of the same type are OR'd, so the union of their
+// index entries holds every match of that type, and as the types are AND'd the
+// smallest of those unions is enough. When no type can be answered from an
+// index every extension is returned and the filter has to do all the work.
+func (c *Catalog) Candidates(filter marketplace.QueryFilter) []marketplace.Extension {
+	groups := map[marketplace.FilterType]map[int]bool{}
+	unindexed := map[marketplace.FilterType]bool{}
+	add := func(group marketplace.FilterType, entries ...int) {
+		if groups[group] == nil {
+			groups[group] = map[int]bool{}
+		}
+		for _, n := range entries {
+			groups[group][n] = true
+		}
+	}
+
+	var best []int
+	found := false
+	narrow := func(entries []int) {
+		if !found || len(entries) < len(best) {
+			best, found = entries, true
+		}
+	}
+
+	for _, criteria := range filter.Criteria {
+		value := strings.ToLower(criteria.Value)
+		switch criteria.FilterType {
+		case marketplace.FilterTypeId:
+			add(marketplace.FilterTypeName, entry(c.ids, value)...)
+		case marketplace.FilterTypeName:
+			add(marketplace.FilterTypeName, entry(c.names, value)...)
+		case marketplace.FilterTypeExtensionName, marketplace.FilterTypeDisplayName:
+			unindexed[marketplace.FilterTypeName] = true
+		case marketplace.FilterTypePublisherName:
+			add(criteria.FilterType, c.publishers[value]...)
+		case marketplace.FilterTypeTag, marketplace.FilterTypeContributionType:
+			add(criteria.FilterType, c.tags[value]...)
+		case marketplace.FilterTypeCategory:
+			narrow(c.categories[value]) // every category is AND'd
+		case marketplace.FilterTypeTargetPlatform:
+			// universal builds run on every platform
+			add(criteria.FilterType, c.platforms[value]...)
+			add(criteria.FilterType, c.platforms[marketplace.TargetPlatformUniversal]...)
+		case marketplace.FilterTypeFeatured, marketplace.FilterTypeFeaturedInCategory:
+			add(criteria.FilterType)
+			for _, identity := range c.featured {
+				add(criteria.FilterType, entry(c.names, strings.ToLower(identity))...)
+			}
+		}
+	}
+
+	for group, entries := range groups {
+		if !unindexed[group] {
+			narrow(slices.Sorted(maps.Keys(entries)))
+		}
+	}
+
+	if !found {
+		return c.Extensions()
+	}
+	return c.lookup(best)
+}
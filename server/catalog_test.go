@@ -0,0 +1,82 @@
+package server
+
+import (
+	"encoding/json"
+	"io/fs"
+	"os"
+	"slices"
+	"testing"
+	"testing/fstest"
+
+	"github.com/wandel/vscmirror/marketplace"
+)
+
+// The queries are shared with the marketplace filter tests.
+func TestCatalogCandidates(t *testing.T) {
+	data, err := os.ReadFile("../marketplace/testdata/queries.json")
+	if err != nil {
+		t.Fatalf("failed to read queries: %v", err)
+	}
+
+	var queries struct {
+		Extensions []marketplace.Extension `json:"extensions"`
+		Tests      []struct {
+			Name     string                   `json:"name"`
+			Featured []string                 `json:"featured"`
+			Request  marketplace.QueryRequest `json:"request"`
+		} `json:"tests"`
+	}
+	if err := json.Unmarshal(data, &queries); err != nil {
+		t.Fatalf("failed to decode queries: %v", err)
+	}
+
+	for _, test := range queries.Tests {
+		t.Run(test.Name, func(t *testing.T) {
+			catalog := NewCatalog(queries.Extensions, test.Featured)
+			filter := test.Request.Filters[0]
+			got := identities(catalog.Filter(filter))
+			want := identities(filter.Filter(catalog.Extensions(), test.Featured))
+			if !slices.Equal(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestLoadCatalogFeatured(t *testing.T) {
+	defer func(artifacts fs.FS, featured []string) { ARTIFACTS, FEATURED = artifacts, featured }(ARTIFACTS, FEATURED)
+	ARTIFACTS = fstest.MapFS{
+		"extensions/featured.json":                  {Data: []byte(`["redhat.vscode-yaml"]`)},
+		"extensions/redhat.vscode-yaml/latest.json": {Data: []byte(`{"publisher":{"publisherName":"redhat"},"extensionName":"vscode-yaml"}`)},
+		"extensions/ms-python.python/latest.json":   {Data: []byte(`{"publisher":{"publisherName":"ms-python"},"extensionName":"python"}`)},
+	}
+	featured := marketplace.QueryFilter{Criteria: []marketplace.FilterCriteria{{FilterType: marketplace.FilterTypeFeatured}}}
+
+	tests := []struct {
+		override []string
+		want     []string
+	}{
+		{nil, []string{"redhat.vscode-yaml"}},
+		{[]string{"ms-python.python"}, []string{"ms-python.python"}},
+	}
+
+	for _, test := range tests {
+		FEATURED = test.override
+		catalog, err := LoadCatalog()
+		if err != nil {
+			t.Fatalf("failed to load catalog: %v", err)
+		}
+
+		if got := identities(catalog.Filter(featured)); !slices.Equal(got, test.want) {
+			t.Errorf("featured with override %v: got %v, want %v", test.override, got, test.want)
+		}
+	}
+}
+
+func identities(extensions []marketplace.Extension) []string {
+	results := []string{}
+	for _, extension := range extensions {
+		results = append(results, extension.Identity())
+	}
+	return results
+}
@@ -7,17 +7,56 @@ import (
 	"io/fs"
 	"log/slog"
 	"net/http"
+	"net/netip"
+	"net/url"
 	"os"
 	"path"
 	"slices"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/wandel/vscmirror/common"
+	"github.com/wandel/vscmirror/config"
 	"github.com/wandel/vscmirror/marketplace"
 )
 
 var ARTIFACTS = os.DirFS("D:\\vscmirror")
 var DOMAIN = "https://vscode.cdn.local/"
+var FEATURED = config.Default().Featured
+
+// INSTALLERS holds the installer settings, it is replaced as a whole when the
+// configuration is reloaded.
+var INSTALLERS atomic.Pointer[config.Installers]
+
+// Configure serves the artifact root of cfg under its public base url.
+func Configure(cfg config.Config) {
+	ARTIFACTS = cfg.Artifacts()
+	DOMAIN = strings.TrimSuffix(cfg.BaseUrl, "/") + "/"
+	INSTALLERS.Store(&cfg.Installers)
+	FEATURED = cfg.Featured
+}
+
+// Reconfigure applies the settings of cfg that can change while serving, the
+// installer pins and rollout and the featured extensions, and reloads the
+// catalog. Changing the root, base url or address needs a restart.
+func Reconfigure(cfg config.Config) error {
+	INSTALLERS.Store(&cfg.Installers)
+
+	reloadMu.Lock()
+	FEATURED = cfg.Featured
+	reloadMu.Unlock()
+
+	return Reload()
+}
+
+// installers returns the installer settings in use.
+func installers() config.Installers {
+	if installers := INSTALLERS.Load(); installers != nil {
+		return *installers
+	}
+	return config.Default().Installers
+}
 
 func NewServeMux() *http.ServeMux {
 	mux := http.NewServeMux()
@@ -26,6 +65,7 @@ func NewServeMux() *http.ServeMux {
 
 	// Installer Auto Update
 	mux.HandleFunc("GET /api/update/{platform}/{quality}/{commit}", CheckInstallerHandler)
+	mux.HandleFunc("GET /api/versions/{commit}/{platform}/{quality}", CommitInstallerHandler)
 	mux.HandleFunc("GET /{commit}/{platform}/{quality}", DownloadInstallerHandler)
 
 	// Extension Marketplace
@@ -34,13 +74,22 @@ func NewServeMux() *http.ServeMux {
 	mux.HandleFunc("POST /_apis/public/gallery/extensionquery", GalleryQueryHandler)
 	mux.HandleFunc("GET /_apis/public/gallery/vscode/{publisher}/{extension}/latest", GalleryLatestHandler)
 	mux.HandleFunc("GET /_gallery/{publisher}/{extension}/latest", GalleryLatestHandler)
-	mux.HandleFunc("GET vscode.cdn.local/extensions/", DownloadExtensionHandler)
+	// host specific so it doesn't clash with the installer download route
+	mux.HandleFunc("GET "+domainHost()+"/extensions/", DownloadExtensionHandler)
 	// Handles the
 	mux.HandleFunc("OPTIONS /", OptionsHandler)
 
 	return mux
 }
 
+func domainHost() string {
+	u, err := url.Parse(DOMAIN)
+	if err != nil || u.Host == "" {
+		return "vscode.cdn.local"
+	}
+	return u.Host
+}
+
 func OptionsHandler(w http.ResponseWriter, r *http.Request) {
 	slog.Info("request", "handler", "OptionsHandler", "remote", r.RemoteAddr, "url", r.URL.String())
 	w.Header().Set("access-control-allow-origin", "*")
@@ -81,22 +130,22 @@ func CheckInstallerHandler(w http.ResponseWriter, r *http.Request) {
 
 	slog.Info("installer update check", "platform", platform, "quality", quality, "commit", commit)
 
-	path := path.Join("installers", platform, quality, "latest.json")
-	var installer common.ProductInfoEx
-	if err := common.LoadJsonFS(ARTIFACTS, path, &installer); err != nil {
-		slog.Error("failed to load latest installer metadata", "error", err)
+	installer, ok, err := advertisedInstaller(r, platform, quality, commit)
+	if err != nil {
+		slog.Error("failed to load installer metadata", "error", err)
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
 
-	// already at the latest version
-	if installer.Version == commit {
+	// already at the advertised version
+	if !ok || installer.Version == commit {
 		slog.Debug("no update found", "platform", platform, "quality", quality, "commit", commit)
 		w.WriteHeader(http.StatusNoContent)
 		return
 	}
 
-	installer.Url = DOMAIN + installer.GetDownloadUrl()
+	// served by DownloadInstallerHandler, the commit picks the exact build
+	installer.Url = DOMAIN + path.Join("commit:"+installer.Version, installer.Identity, installer.Quality)
 	data, err := json.Marshal(installer)
 	if err != nil {
 		slog.Error("failed to encode", "error", err)
@@ -106,10 +155,74 @@ func CheckInstallerHandler(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 	if _, err := w.Write(data); err != nil {
-		slog.Error("check installer failed to send body", "file", path, "error", err)
+		slog.Error("check installer failed to send body", "commit", installer.Version, "error", err)
+	}
+}
+
+// advertisedInstaller picks the build offered to a client running commit. Pinned
+// clients get their pinned build, everyone else the newest build the staged
+// rollout has reached them with. ok is false when there is nothing to offer,
+// e.g. the client already runs a build that is newer than what it would get.
+func advertisedInstaller(r *http.Request, platform, quality, commit string) (common.ProductInfoEx, bool, error) {
+	var installer common.ProductInfoEx
+	settings := installers()
+
+	// admins can hold clients on an older build, e.g. to roll back a bad release
+	if pinned, ok := settings.Pinned(platform, quality, remoteAddr(r)); ok {
+		slog.Info("installer pinned", "platform", platform, "quality", quality, "pinned", pinned)
+		filepath := path.Join("installers", platform, quality, pinned+".json")
+		err := common.LoadJsonFS(ARTIFACTS, filepath, &installer)
+		if err == nil {
+			return installer, true, nil
+		}
+		// better to keep the clients updating than to leave them stuck
+		slog.Warn("pinned installer is not mirrored, ignoring pin", "platform", platform, "quality", quality, "pinned", pinned, "error", err)
 	}
+
+	rollout := settings.Rollout
+	if len(rollout.Stages) == 0 && len(rollout.Halted) == 0 {
+		filepath := path.Join("installers", platform, quality, "latest.json")
+		if err := common.LoadJsonFS(ARTIFACTS, filepath, &installer); err != nil {
+			return installer, false, err
+		}
+		return installer, true, nil
+	}
+
+	history, err := common.LoadInstallers(ARTIFACTS, platform, quality)
+	if err != nil {
+		return installer, false, err
+	} else if len(history) == 0 {
+		return installer, false, fmt.Errorf("no installers for '%s/%s': %w", platform, quality, fs.ErrNotExist)
+	}
+
+	client := remoteAddr(r).String()
+	if rollout.Header != "" {
+		client = r.Header.Get(rollout.Header)
+	}
+
+	for _, installer := range history {
+		if installer.Version == commit {
+			return installer, false, nil // never offer a downgrade
+		} else if rollout.Offered(client, installer.Version, time.Since(installer.Landed())) {
+			return installer, true, nil
+		}
+		slog.Debug("installer rollout has not reached client", "platform", platform, "quality", quality, "commit", installer.Version)
+	}
+
+	return installer, false, nil
 }
 
+func remoteAddr(r *http.Request) netip.Addr {
+	addr, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addr.Addr()
+}
+
+// DownloadInstallerHandler serves a build by commit, which is how Remote-SSH, WSL
+// and tunnels fetch the server and cli matching the client:
+// /commit:{commit}/{platform}/{quality}.
 func DownloadInstallerHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("access-control-allow-origin", "*")
 	slog.Info("request", "handler", "DownloadInstallerHandler", "remote", r.RemoteAddr, "url", r.URL.String())
@@ -132,6 +245,37 @@ func DownloadInstallerHandler(w http.ResponseWriter, r *http.Request) {
 	http.ServeFileFS(w, r, ARTIFACTS, filepath)
 }
 
+// CommitInstallerHandler returns the metadata of a build by commit, with its url
+// pointing at the mirror, like the update server's /api/versions endpoint.
+func CommitInstallerHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Info("request", "handler", "CommitInstallerHandler", "remote", r.RemoteAddr, "url", r.URL.String())
+	w.Header().Set("access-control-allow-origin", "*")
+	platform := r.PathValue("platform")
+	quality := r.PathValue("quality")
+	commit := strings.TrimPrefix(r.PathValue("commit"), "commit:")
+
+	filepath := path.Join("installers", platform, quality, commit+".json")
+	var installer common.ProductInfoEx
+	if err := common.LoadJsonFS(ARTIFACTS, filepath, &installer); err != nil {
+		slog.Error("failed to load installer metadata", "error", err)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	installer.Url = DOMAIN + path.Join("commit:"+installer.Version, platform, quality)
+	data, err := json.Marshal(installer.ProductInfo)
+	if err != nil {
+		slog.Error("failed to encode", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(data); err != nil {
+		slog.Error("commit installer failed to send body", "file", filepath, "error", err)
+	}
+}
+
 func RecommendationHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("access-control-allow-origin", "*")
 	slog.Info("request", "handler", "RecommendationHandler", "remote", r.RemoteAddr, "url", r.URL.String())
@@ -141,17 +285,51 @@ func RecommendationHandler(w http.ResponseWriter, r *http.Request) {
 func MaliciousHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("access-control-allow-origin", "*")
 	slog.Info("request", "handler", "MaliciousHandler", "remote", r.RemoteAddr, "url", r.URL.String())
-	http.ServeFileFS(w, r, ARTIFACTS, "malicious.json")
+	http.ServeFileFS(w, r, ARTIFACTS, "extensions/marketplace.json")
+}
+
+// LoadSelected returns the extensions the sync approved for serving, or nil if
+// it did not record a selection.
+func LoadSelected() ([]string, error) {
+	var selected []string
+	if err := common.LoadJsonFS(ARTIFACTS, "extensions/selected.json", &selected); errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to load selected extensions: %w", err)
+	}
+
+	return selected, nil
+}
+
+func IsSelected(selected []string, identity string) bool {
+	if selected == nil {
+		return true
+	}
+
+	return slices.ContainsFunc(selected, func(value string) bool {
+		return strings.EqualFold(value, identity)
+	})
 }
 
+// LoadExtensions loads the metadata of every mirrored extension. When the sync
+// recorded an extensions/selected.json only the approved extensions are loaded.
 func LoadExtensions(dst *[]marketplace.Extension) error {
 	matches, err := fs.Glob(ARTIFACTS, "extensions/*/latest.json")
 	if err != nil {
 		return fmt.Errorf("failed to glob extensions: %w", err)
 	}
 
+	selected, err := LoadSelected()
+	if err != nil {
+		return err
+	}
+
 	var extensions []marketplace.Extension
 	for _, match := range matches {
+		if !IsSelected(selected, path.Base(path.Dir(match))) {
+			continue
+		}
+
 		var extension marketplace.Extension
 		if err := common.LoadJsonFS(ARTIFACTS, match, &extension); err != nil {
 			slog.Error("failed to load extension metadata", "path", match, "error", err)
@@ -167,31 +345,14 @@ func GalleryLatestHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("access-control-allow-origin", "*")
 	slog.Info("request", "handler", "GalleryLatestHandler", "remote", r.RemoteAddr, "url", r.URL.String())
 	identity := r.PathValue("publisher") + "." + r.PathValue("extension")
-	filepath := path.Join("extensions", identity, "latest.json")
-	f, err := ARTIFACTS.Open(filepath)
-	if err != nil {
-		if errors.Is(err, fs.ErrNotExist) {
-			http.NotFound(w, r)
-			return
-		}
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	extension, ok := Current().Get(identity)
+	if !ok {
+		http.NotFound(w, r)
+		return
 	}
-	defer f.Close()
 
-	var extension marketplace.Extension
-	if err := json.NewDecoder(f).Decode(&extension); err != nil {
-		slog.Error("failed to decode json", "path", filepath, "error", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-	}
-
-	for j, version := range extension.Versions {
-		uri := path.Join("extensions", extension.Publisher.PublisherName+"."+extension.ExtensionName, version.Version, version.TargetPlatform)
-		for k, file := range version.Files {
-			extension.Versions[j].Files[k].Source = DOMAIN + path.Join(uri, file.AssetType)
-		}
-		extension.Versions[j].AssetURI = DOMAIN + uri
-		extension.Versions[j].FallbackAssetURI = DOMAIN + uri
-	}
+	extension.Versions = marketplace.LatestVersions(extension.Versions)
+	extension = rewriteUrls(extension)
 
 	data, err := json.Marshal(extension)
 	if err != nil {
@@ -233,75 +394,76 @@ func GalleryQueryHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	var extensions []marketplace.Extension
-	if err := LoadExtensions(&extensions); err != nil {
-		slog.Error("failed to load extensions", "error", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	// every filter is answered on its own, in the order they were asked, from
+	// the same catalog even if it is reloaded meanwhile
+	catalog := Current()
+	responses := []marketplace.QueryResponse{}
+	for _, filter := range request.Filters {
+		responses = append(responses, queryFilter(catalog, filter, request.Flags))
 	}
 
-	filter := request.Filters[0]
+	wrapper := struct {
+		Results []marketplace.QueryResponse `json:"results"`
+	}{
+		Results: responses,
+	}
 
-	if !marketplace.ShouldSkipFirstStageFilters(filter) {
-		extensions = filter.FilterFirstStage(extensions)
+	data, err := json.Marshal(wrapper)
+	if err != nil {
+		slog.Error("failed to marshal query response", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	extensions = filter.FilterSecondStage(extensions)
 
-	result := []marketplace.Extension{} // initialize so we dont get a null in the json later
-	for _, extension := range extensions {
-		if filter.Matches(extension) {
-			result = append(result, extension)
-		}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
+	if _, err := w.Write(data); err != nil {
+		slog.Error("failed to write query response", "error", err)
+		return
 	}
 
-	if filter.SortOrder == marketplace.SortOrderDefault {
-		switch filter.SortBy {
-		case marketplace.SortByRelevance:
-			filter.SortOrder = marketplace.SortOrderDescending
-		case marketplace.SortByLastUpdatedDate:
-			filter.SortOrder = marketplace.SortOrderDescending
-		case marketplace.SortByTitle:
-			filter.SortOrder = marketplace.SortOrderAscending
-		case marketplace.SortByPublisher:
-			filter.SortOrder = marketplace.SortOrderAscending
-		case marketplace.SortByInstallCount:
-			filter.SortOrder = marketplace.SortOrderDescending
-		case marketplace.SortByPublishedDate:
-			filter.SortOrder = marketplace.SortOrderDescending
-		case marketplace.SortByAverageRating:
-			filter.SortOrder = marketplace.SortOrderDescending
-		case marketplace.SortByTrendingDaily:
-			filter.SortOrder = marketplace.SortOrderDescending
-		case marketplace.SortByTrendingWeekly:
-			filter.SortOrder = marketplace.SortOrderDescending
-		case marketplace.SortByTrendingMonthly:
-			filter.SortOrder = marketplace.SortOrderDescending
-		case marketplace.SortByReleaseDate:
-			filter.SortOrder = marketplace.SortOrderDescending
-		case marketplace.SortByAuthor:
-			filter.SortOrder = marketplace.SortOrderAscending
-		case marketplace.SortByWeightedRating:
-			filter.SortOrder = marketplace.SortOrderDescending
-		default:
-			filter.SortOrder = marketplace.SortOrderAscending
+	return
+}
+
+// queryFilter answers a single filter of a query with its own sorting, paging
+// and metadata.
+func queryFilter(catalog *Catalog, filter marketplace.QueryFilter, flags marketplace.QueryFlag) marketplace.QueryResponse {
+	result := catalog.Filter(filter)
+
+	filter.Sort(result)
+
+	// only return versions that run on the vscode version the client asked for
+	if filter.HasEngineCriteria() {
+		compatible := []marketplace.Extension{}
+		for _, extension := range result {
+			extension.Versions = filter.FilterEngineVersions(extension.Versions)
+			if len(extension.Versions) > 0 {
+				compatible = append(compatible, extension)
+			}
 		}
+		result = compatible
 	}
 
-	slices.SortFunc(result, filter.Compare)
-	if filter.SortOrder == marketplace.SortOrderDescending {
-		slices.Reverse(result)
+	// only return the builds for the platforms the client asked for
+	if platforms := filter.TargetPlatforms(); len(platforms) > 0 {
+		available := []marketplace.Extension{}
+		for _, extension := range result {
+			extension.Versions = marketplace.FilterTargetPlatforms(extension.Versions, platforms)
+			if len(extension.Versions) > 0 {
+				available = append(available, extension)
+			}
+		}
+		result = available
 	}
 
-	// Change Urls to point to us, mimicking vscodeoffline
-	for i, extension := range result {
-		for j, version := range extension.Versions {
-			identity := extension.Publisher.PublisherName + "." + extension.ExtensionName
-			uri := path.Join("extensions", identity, version.Version, version.TargetPlatform)
-			for k, file := range version.Files {
-				result[i].Versions[j].Files[k].Source = DOMAIN + path.Join(uri, file.AssetType)
-			}
-			result[i].Versions[j].AssetURI = DOMAIN + uri
-			result[i].Versions[j].FallbackAssetURI = DOMAIN + uri
+	// every retained version is returned unless the client only wants the latest
+	if flags&marketplace.QueryFlagIncludeLatestVersionOnly != 0 {
+		for i, extension := range result {
+			result[i].Versions = marketplace.LatestVersions(extension.Versions)
+		}
+	} else if flags&marketplace.QueryFlagIncludeLatestPrereleaseAndStableVersionOnly != 0 {
+		for i, extension := range result {
+			result[i].Versions = marketplace.LatestStableAndPreReleaseVersions(extension.Versions)
 		}
 	}
 
@@ -343,7 +505,13 @@ func GalleryQueryHandler(w http.ResponseWriter, r *http.Request) {
 
 	// pageNumber starts at 1, not 0 so we correct it here.
 	result = paginate(result, filter.PageNumber-1, filter.PageSize)
-	response := marketplace.QueryResponse{
+
+	// Change Urls to point to us, mimicking vscodeoffline
+	for i, extension := range result {
+		result[i] = rewriteUrls(extension)
+	}
+
+	return marketplace.QueryResponse{
 		Extensions: result,
 		ResultMetadata: []marketplace.QueryResultMetadata{
 			marketplace.QueryResultMetadata{
@@ -362,28 +530,21 @@ func GalleryQueryHandler(w http.ResponseWriter, r *http.Request) {
 			},
 		},
 	}
+}
 
-	wrapper := struct {
-		Results []marketplace.QueryResponse `json:"results"`
-	}{
-		Results: []marketplace.QueryResponse{response},
-	}
-
-	data, err := json.Marshal(wrapper)
-	if err != nil {
-		slog.Error("failed to marshal query response", "error", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
-	if _, err := w.Write(data); err != nil {
-		slog.Error("failed to write query response", "error", err)
-		return
+// rewriteUrls returns a copy of the extension with its asset urls pointing at
+// the mirror.
+func rewriteUrls(extension marketplace.Extension) marketplace.Extension {
+	extension = extension.Clone()
+	for j, version := range extension.Versions {
+		uri := path.Join("extensions", extension.Identity(), version.Version, version.TargetPlatform)
+		for k, file := range version.Files {
+			extension.Versions[j].Files[k].Source = DOMAIN + path.Join(uri, file.AssetType)
+		}
+		extension.Versions[j].AssetURI = DOMAIN + uri
+		extension.Versions[j].FallbackAssetURI = DOMAIN + uri
 	}
-
-	return
+	return extension
 }
 
 func paginate[T any](values []T, page, count int) []T {
@@ -0,0 +1,27 @@
+package server
+
+import (
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+)
+
+func TestMaliciousHandler(t *testing.T) {
+	defer func(artifacts fs.FS) { ARTIFACTS = artifacts }(ARTIFACTS)
+	// the sync mirrors the list where the cdn serves it
+	ARTIFACTS = fstest.MapFS{
+		"extensions/marketplace.json": {Data: []byte(`{"malicious":["evil.extension"]}`)},
+	}
+
+	recorder := httptest.NewRecorder()
+	MaliciousHandler(recorder, httptest.NewRequest("GET", "/extensions/marketplace.json", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", recorder.Code, http.StatusOK)
+	}
+	if body := recorder.Body.String(); body != `{"malicious":["evil.extension"]}` {
+		t.Errorf("got %q, want the mirrored list", body)
+	}
+}
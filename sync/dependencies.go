@@ -0,0 +1,130 @@
+package sync
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/wandel/vscmirror/common"
+	"github.com/wandel/vscmirror/marketplace"
+)
+
+// dependencyBatchSize bounds the number of names sent in a single query.
+const dependencyBatchSize = 100
+
+// ResolveDependencies walks the ExtensionDependencies and ExtensionPack
+// properties of the selected extensions transitively, mirroring anything that
+// is missing. It returns the identities that are only mirrored because a
+// selected extension needs them.
+func ResolveDependencies(ctx context.Context, client *marketplace.Client, downloader *Downloader, state State, selected map[string]marketplace.Extension) map[string]bool {
+	known := map[string]string{}
+	for identity := range state.Extensions {
+		known[strings.ToLower(identity)] = identity
+	}
+
+	var queue []string
+	for _, extension := range selected {
+		queue = append(queue, extensionDependencies(extension)...)
+	}
+
+	required := map[string]bool{}
+	visited := map[string]bool{}
+	for len(queue) > 0 && ctx.Err() == nil {
+		var next, missing []string
+		for _, name := range queue {
+			id := strings.ToLower(name)
+			if visited[id] {
+				continue
+			}
+			visited[id] = true
+
+			identity, ok := known[id]
+			if !ok {
+				missing = append(missing, name)
+				continue
+			} else if _, ok := selected[identity]; ok {
+				continue // its dependencies are already queued
+			}
+
+			extension, err := loadExtension(identity)
+			if err != nil {
+				slog.Warn("failed to load dependency metadata", "extension", identity, "error", err)
+				continue
+			}
+			required[identity] = true
+			next = append(next, extensionDependencies(extension)...)
+		}
+
+		for batch := range slices.Chunk(missing, dependencyBatchSize) {
+			extensions, err := client.GetExtensionsByName(ctx, batch)
+			if err != nil {
+				slog.Error("failed to query dependencies", "names", batch, "error", err)
+				continue
+			}
+
+			found := map[string]bool{}
+			for _, extension := range extensions {
+				identity := extension.Identity()
+				found[strings.ToLower(identity)] = true
+				if SELECTION.Exclude.Matches(extension) {
+					slog.Warn("dependency is excluded, installs depending on it will fail", "extension", identity)
+					continue
+				}
+
+				upstream := UpstreamVersion(extension)
+				extension, err := PrepareExtension(ctx, client, extension)
+				if err != nil {
+					slog.Error("failed to prepare dependency", "extension", identity, "error", err)
+					continue
+				}
+
+				current, err := DownloadExtension(ctx, downloader, extension, state.Extensions[identity])
+				if err != nil {
+					slog.Error("failed to download dependency", "extension", identity, "error", err)
+					continue
+				}
+				current.Upstream = upstream
+				current.Dependency = true
+				state.Extensions[identity] = current
+				known[strings.ToLower(identity)] = identity
+				required[identity] = true
+				next = append(next, extensionDependencies(extension)...)
+			}
+
+			for _, name := range batch {
+				if !found[strings.ToLower(name)] {
+					slog.Warn("dependency not found in the marketplace", "extension", name)
+				}
+			}
+		}
+
+		queue = next
+	}
+
+	added := slices.Sorted(maps.Keys(required))
+	slog.Info("resolved extension dependencies", "count", len(added), "extensions", added)
+	return required
+}
+
+func extensionDependencies(extension marketplace.Extension) []string {
+	var dependencies []string
+	for _, version := range extension.Versions {
+		for _, dependency := range version.Dependencies() {
+			if !slices.Contains(dependencies, dependency) {
+				dependencies = append(dependencies, dependency)
+			}
+		}
+	}
+
+	return dependencies
+}
+
+func loadExtension(identity string) (marketplace.Extension, error) {
+	var extension marketplace.Extension
+	filename := path.Join("extensions", identity, "latest.json")
+	err := common.LoadJsonFS(ARTIFACTS, filename, &extension)
+	return extension, err
+}
@@ -0,0 +1,343 @@
+package sync
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	gosync "sync"
+	"time"
+)
+
+// LIMITED_HOSTS are the upstream hosts (and their subdomains) that the
+// requests per second cap applies to.
+var LIMITED_HOSTS = []string{"gallerycdn.vsassets.io", "update.code.visualstudio.com"}
+
+// Downloader is the engine used to fetch artifacts. Workers bounds how many
+// downloads run at once, BytesPerSecond caps the combined bandwidth and
+// RequestsPerSecond caps the request rate towards each of the LIMITED_HOSTS.
+// A zero limit means unlimited.
+type Downloader struct {
+	HttpClient        *http.Client
+	Workers           int
+	BytesPerSecond    int64
+	RequestsPerSecond float64
+
+	once      gosync.Once
+	slots     chan struct{}
+	bandwidth *limiter
+	requests  map[string]*limiter
+}
+
+func (d *Downloader) init() {
+	d.once.Do(func() {
+		if d.HttpClient == nil {
+			d.HttpClient = http.DefaultClient
+		}
+
+		if d.Workers < 1 {
+			d.Workers = 1
+		}
+		d.slots = make(chan struct{}, d.Workers)
+
+		if d.BytesPerSecond > 0 {
+			d.bandwidth = newLimiter(float64(d.BytesPerSecond))
+		}
+
+		d.requests = map[string]*limiter{}
+		if d.RequestsPerSecond > 0 {
+			for _, host := range LIMITED_HOSTS {
+				d.requests[host] = newLimiter(d.RequestsPerSecond)
+			}
+		}
+	})
+}
+
+// Run calls fn for every value received from values on up to Workers
+// goroutines, returning once values is closed and every call has finished.
+func Run[T any](d *Downloader, values <-chan T, fn func(T)) {
+	d.init()
+
+	var wg gosync.WaitGroup
+	for range d.Workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for value := range values {
+				fn(value)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Download fetches url into filename, waiting for a free worker and for the
+// rate limits before sending the request. The body is written to a ".partial"
+// file next to filename and is only renamed into place once the length and,
+// when hash is not empty, the sha256 hash have been verified. A ".partial"
+// file left behind by an earlier run is only resumed with a Range request when
+// hash is known, as nothing else would catch the upstream file changing in
+// between, and a resumed download that fails the hash is fetched again from
+// the start. The sha256 hash of the file is returned.
+func (d *Downloader) Download(ctx context.Context, url string, filename string, hash string) (string, error) {
+	d.init()
+
+	select {
+	case d.slots <- struct{}{}:
+		defer func() { <-d.slots }()
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+
+	partial := filename + ".partial"
+	actual, resumed, err := d.download(ctx, url, partial, hash != "")
+	if errors.Is(err, errRangeNotSatisfiable) || (err == nil && resumed && !strings.EqualFold(hash, actual)) {
+		slog.Warn("discarding unresumable partial download", "path", partial)
+		if err := os.Remove(partial); err != nil {
+			return "", fmt.Errorf("failed to remove '%s': %w", partial, err)
+		}
+		actual, _, err = d.download(ctx, url, partial, false)
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	if hash != "" && !strings.EqualFold(hash, actual) {
+		os.Remove(partial)
+		return "", fmt.Errorf("sha256 mismatch for '%s': expected %s, got %s", url, hash, actual)
+	}
+
+	if err := os.Rename(partial, filename); err != nil {
+		return "", fmt.Errorf("failed to move '%s' into place: %w", filename, err)
+	}
+
+	return actual, nil
+}
+
+// ErrNotFound is returned when the upstream does not have the requested resource.
+var ErrNotFound = errors.New("not found")
+
+// GetJson decodes the json document at url into value, subject to the same
+// limits as Download. ErrNotFound is returned for 404 and 204 responses.
+func (d *Downloader) GetJson(ctx context.Context, url string, value any) error {
+	d.init()
+
+	select {
+	case d.slots <- struct{}{}:
+		defer func() { <-d.slots }()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if limiter := d.limiterFor(url); limiter != nil {
+		if err := limiter.Wait(ctx, 1); err != nil {
+			return err
+		}
+	}
+
+	request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request to '%s': %w", url, err)
+	}
+
+	resp, err := d.HttpClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("http request GET '%s' failed: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusNoContent:
+		return ErrNotFound
+	default:
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(value); err != nil {
+		return fmt.Errorf("failed to json decode '%s': %w", url, err)
+	}
+
+	return nil
+}
+
+var errRangeNotSatisfiable = errors.New("range not satisfiable")
+
+// download writes url to partial, continuing after the bytes already in it if
+// resume is set and truncating it otherwise. It reports whether the download
+// was resumed.
+func (d *Downloader) download(ctx context.Context, url string, partial string, resume bool) (string, bool, error) {
+	if err := os.MkdirAll(filepath.Dir(partial), 0755); err != nil {
+		return "", false, fmt.Errorf("failed to create parent directory of '%s': %w", partial, err)
+	}
+
+	flags := os.O_RDWR | os.O_CREATE
+	if !resume {
+		flags |= os.O_TRUNC
+	}
+
+	f, err := os.OpenFile(partial, flags, 0644)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to open '%s': %w", partial, err)
+	}
+	defer f.Close()
+
+	// hash whatever an earlier run managed to download
+	hash := sha256.New()
+	offset, err := io.Copy(hash, f)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to read '%s': %w", partial, err)
+	}
+
+	if limiter := d.limiterFor(url); limiter != nil {
+		if err := limiter.Wait(ctx, 1); err != nil {
+			return "", false, err
+		}
+	}
+
+	request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to create request to '%s': %w", url, err)
+	}
+
+	if offset > 0 {
+		request.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := d.HttpClient.Do(request)
+	if err != nil {
+		return "", false, fmt.Errorf("http request GET '%s' failed: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if offset > 0 {
+			// the server ignored the range, start over
+			offset = 0
+			hash.Reset()
+			if err := f.Truncate(0); err != nil {
+				return "", false, fmt.Errorf("failed to truncate '%s': %w", partial, err)
+			}
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return "", false, fmt.Errorf("failed to seek '%s': %w", partial, err)
+			}
+		}
+	case http.StatusPartialContent:
+		var start int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start); err != nil || start != offset {
+			return "", false, fmt.Errorf("unexpected content range '%s' resuming '%s'", resp.Header.Get("Content-Range"), url)
+		}
+		slog.Debug("resuming download", "url", url, "offset", offset)
+	case http.StatusRequestedRangeNotSatisfiable:
+		return "", false, errRangeNotSatisfiable
+	default:
+		return "", false, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var body io.Reader = resp.Body
+	if d.bandwidth != nil {
+		body = &limitedReader{ctx: ctx, r: resp.Body, limiter: d.bandwidth}
+	}
+
+	slog.Debug("downloading", "url", url, "path", partial)
+	written, err := io.Copy(io.MultiWriter(f, hash), body)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to write to '%s': %w", partial, err)
+	}
+
+	if resp.ContentLength >= 0 && written != resp.ContentLength {
+		return "", false, fmt.Errorf("short download of '%s': expected %d bytes, got %d", url, resp.ContentLength, written)
+	}
+
+	if err := f.Sync(); err != nil {
+		return "", false, fmt.Errorf("failed to sync '%s': %w", partial, err)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), offset > 0, nil
+}
+
+func (d *Downloader) limiterFor(rawUrl string) *limiter {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil
+	}
+
+	host := strings.ToLower(u.Hostname())
+	for suffix, limiter := range d.requests {
+		if host == suffix || strings.HasSuffix(host, "."+suffix) {
+			return limiter
+		}
+	}
+
+	return nil
+}
+
+// limiter is a token bucket that allows going into debt, so a single large
+// request is delayed proportionally rather than rejected.
+type limiter struct {
+	mu     gosync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter(rate float64) *limiter {
+	return &limiter{
+		rate:   rate,
+		tokens: rate, // allow up to one second worth of burst
+		last:   time.Now(),
+	}
+}
+
+func (l *limiter) Wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	delay := time.Duration(0)
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if delay == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type limitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *limiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if err := r.limiter.Wait(r.ctx, n); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,157 @@
+package sync
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testArtifact serves content with range support and records the Range
+// header of every request.
+type testArtifact struct {
+	content []byte
+	ranges  []string
+}
+
+func (a *testArtifact) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.ranges = append(a.ranges, r.Header.Get("Range"))
+	http.ServeContent(w, r, "artifact", time.Time{}, bytes.NewReader(a.content))
+}
+
+func sha256Hex(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// downloadTest downloads the handler's artifact into a temp directory that
+// already holds partial as the ".partial" file when it is not nil.
+func downloadTest(t *testing.T, handler http.Handler, partial []byte, hash string) (string, string, error) {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	filename := filepath.Join(t.TempDir(), "artifact")
+	if partial != nil {
+		if err := os.WriteFile(filename+".partial", partial, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	downloader := &Downloader{HttpClient: server.Client()}
+	actual, err := downloader.Download(context.Background(), server.URL, filename, hash)
+	return filename, actual, err
+}
+
+func checkArtifact(t *testing.T, filename string, want []byte) {
+	t.Helper()
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("failed to read download: %v", err)
+	}
+	if !bytes.Equal(data, want) {
+		t.Errorf("downloaded %q, want %q", data, want)
+	}
+	if _, err := os.Stat(filename + ".partial"); !os.IsNotExist(err) {
+		t.Errorf("partial download left behind: %v", err)
+	}
+}
+
+func TestDownloadResume(t *testing.T) {
+	artifact := &testArtifact{content: []byte("the quick brown fox jumps over the lazy dog")}
+
+	filename, actual, err := downloadTest(t, artifact, artifact.content[:10], sha256Hex(artifact.content))
+	if err != nil {
+		t.Fatalf("failed to download: %v", err)
+	}
+
+	checkArtifact(t, filename, artifact.content)
+	if actual != sha256Hex(artifact.content) {
+		t.Errorf("got hash %s, want %s", actual, sha256Hex(artifact.content))
+	}
+	if len(artifact.ranges) != 1 || artifact.ranges[0] != "bytes=10-" {
+		t.Errorf("sent ranges %q, want a single resume at 10", artifact.ranges)
+	}
+}
+
+func TestDownloadResumeWithoutHash(t *testing.T) {
+	artifact := &testArtifact{content: []byte("the quick brown fox jumps over the lazy dog")}
+
+	// nothing could tell that the partial file belongs to the same upstream file
+	filename, _, err := downloadTest(t, artifact, []byte("stale"), "")
+	if err != nil {
+		t.Fatalf("failed to download: %v", err)
+	}
+
+	checkArtifact(t, filename, artifact.content)
+	if len(artifact.ranges) != 1 || artifact.ranges[0] != "" {
+		t.Errorf("sent ranges %q, want a single full download", artifact.ranges)
+	}
+}
+
+func TestDownloadResumeChanged(t *testing.T) {
+	artifact := &testArtifact{content: []byte("the quick brown fox jumps over the lazy dog")}
+
+	// the partial file was left behind by an older build of the artifact
+	filename, _, err := downloadTest(t, artifact, []byte("an older build"), sha256Hex(artifact.content))
+	if err != nil {
+		t.Fatalf("failed to download: %v", err)
+	}
+
+	checkArtifact(t, filename, artifact.content)
+	if len(artifact.ranges) != 2 || artifact.ranges[1] != "" {
+		t.Errorf("sent ranges %q, want a resume followed by a full download", artifact.ranges)
+	}
+}
+
+func TestDownloadRangeNotSatisfiable(t *testing.T) {
+	artifact := &testArtifact{content: []byte("short")}
+
+	filename, _, err := downloadTest(t, artifact, []byte("longer than the artifact"), sha256Hex(artifact.content))
+	if err != nil {
+		t.Fatalf("failed to download: %v", err)
+	}
+
+	checkArtifact(t, filename, artifact.content)
+	if len(artifact.ranges) != 2 {
+		t.Errorf("sent ranges %q, want a resume followed by a full download", artifact.ranges)
+	}
+}
+
+func TestDownloadShort(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		w.Write([]byte("truncated"))
+	})
+
+	filename, _, err := downloadTest(t, handler, nil, "")
+	if err == nil {
+		t.Fatal("short download succeeded")
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("short download was moved into place: %v", err)
+	}
+}
+
+func TestDownloadHashMismatch(t *testing.T) {
+	artifact := &testArtifact{content: []byte("tampered")}
+
+	filename, _, err := downloadTest(t, artifact, nil, sha256Hex([]byte("original")))
+	if err == nil || !strings.Contains(err.Error(), "sha256 mismatch") {
+		t.Fatalf("got %v, want a sha256 mismatch", err)
+	}
+	for _, name := range []string{filename, filename + ".partial"} {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("mismatched download left at '%s': %v", name, err)
+		}
+	}
+}
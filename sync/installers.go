@@ -0,0 +1,438 @@
+package sync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	gosync "sync"
+	"time"
+
+	"github.com/wandel/vscmirror/common"
+)
+
+type installerQuery struct {
+	Platform     string
+	Architecture string
+	BuildType    string
+	Quality      string
+	// Commit is set when a specific build rather than the latest is wanted.
+	Commit string
+}
+
+// DownloadInstallers mirrors the latest vscode build for every configured
+// combination of platform, architecture, build type and quality, writing the
+// installers/{identity}/{quality}/latest.json and {commit}.json metadata the
+// server reads next to the installer itself.
+func DownloadInstallers(ctx context.Context, downloader *Downloader) error {
+	queue := make(chan installerQuery)
+	go func() {
+		defer close(queue)
+		for _, quality := range INSTALLERS.Qualities {
+			for _, platform := range INSTALLERS.Platforms {
+				for _, architecture := range INSTALLERS.Architectures {
+					for _, buildType := range INSTALLERS.BuildTypes {
+						if buildType != "" && platform != "win32" {
+							continue
+						}
+
+						select {
+						case queue <- installerQuery{platform, architecture, buildType, quality, ""}:
+						case <-ctx.Done():
+							return
+						}
+					}
+				}
+			}
+		}
+	}()
+
+	var mu gosync.Mutex
+	count, failed := 0, 0
+	Run(downloader, queue, func(query installerQuery) {
+		identity := common.Identity(query.Platform, query.Architecture, query.BuildType)
+		err := DownloadLatestInstaller(ctx, downloader, query)
+
+		mu.Lock()
+		defer mu.Unlock()
+		if errors.Is(err, ErrNotFound) {
+			slog.Debug("no installer for platform", "identity", identity, "quality", query.Quality)
+		} else if err != nil {
+			slog.Error("failed to download installer", "identity", identity, "quality", query.Quality, "error", err)
+			failed += 1
+		} else {
+			count += 1
+		}
+	})
+
+	slog.Info("downloaded installers", "count", count, "failed", failed)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// the remote builds are still mirrored when a pin fails
+	pinned := DownloadPinnedInstallers(ctx, downloader)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return errors.Join(pinned, DownloadRemoteInstallers(ctx, downloader))
+}
+
+// IsClientInstaller reports whether DownloadInstallers mirrors the latest build
+// of the identity and quality, and so writes its latest.json.
+func IsClientInstaller(identity, quality string) bool {
+	platform, architecture, buildType := common.SplitIdentity(identity)
+	if buildType != "" && platform != "win32" {
+		return false
+	}
+
+	return slices.Contains(INSTALLERS.Qualities, quality) &&
+		slices.Contains(INSTALLERS.Platforms, platform) &&
+		slices.Contains(INSTALLERS.Architectures, architecture) &&
+		slices.Contains(INSTALLERS.BuildTypes, buildType)
+}
+
+// DownloadLatestInstaller asks the update server for the latest build of the
+// platform and mirrors it. ErrNotFound is returned if the update server has no
+// such build.
+func DownloadLatestInstaller(ctx context.Context, downloader *Downloader, query installerQuery) error {
+	identity := common.Identity(query.Platform, query.Architecture, query.BuildType)
+	url := fmt.Sprintf("%s/api/update/%s/%s/latest", strings.TrimSuffix(UPSTREAM.Update, "/"), identity, query.Quality)
+
+	installer := common.ProductInfoEx{
+		Identity:     identity,
+		Platform:     query.Platform,
+		Architecture: query.Architecture,
+		BuildType:    query.BuildType,
+		Quality:      query.Quality,
+	}
+	if err := downloader.GetJson(ctx, url, &installer.ProductInfo); err != nil {
+		return err
+	}
+	installer.UpdateUrl = installer.Url
+
+	// keep when the build first landed, the staged rollout is timed from it
+	installer.Mirrored = time.Now()
+	var existing common.ProductInfoEx
+	if err := common.LoadJsonFS(ARTIFACTS, path.Join("installers", identity, query.Quality, installer.Version+".json"), &existing); err == nil {
+		installer.Mirrored = existing.Landed()
+	}
+
+	if err := DownloadInstaller(ctx, downloader, installer); err != nil {
+		return err
+	}
+
+	if err := WriteInstaller(installer, true); err != nil {
+		return err
+	}
+
+	return ExpireInstallers(identity, query.Quality)
+}
+
+// DownloadInstaller fetches the installer into the path the server serves it
+// from, verifying it against the published sha256 hash.
+func DownloadInstaller(ctx context.Context, downloader *Downloader, installer common.ProductInfoEx) error {
+	filename := filepath.Join(ROOT, filepath.FromSlash(installer.GetDownloadUrl()))
+	metadata := path.Join("installers", installer.Identity, installer.Quality, installer.Version+".json")
+	if _, err := os.Stat(filename); err == nil {
+		if _, err := os.Stat(filepath.Join(ROOT, filepath.FromSlash(metadata))); err == nil {
+			return nil // already mirrored
+		}
+	}
+
+	slog.Info("downloading installer", "identity", installer.Identity, "quality", installer.Quality, "version", installer.ProductVersion)
+	if _, err := downloader.Download(ctx, installer.Url, filename, installer.SHA256Hash); err != nil {
+		return fmt.Errorf("failed to download installer '%s': %w", installer.Name, err)
+	}
+
+	return nil
+}
+
+// WriteInstaller writes the {commit}.json metadata of the installer and, if
+// latest is set, points latest.json at it.
+func WriteInstaller(installer common.ProductInfoEx, latest bool) error {
+	data, err := json.Marshal(installer)
+	if err != nil {
+		return fmt.Errorf("failed to marshal installer metadata: %w", err)
+	}
+
+	dir := filepath.Join(ROOT, "installers", installer.Identity, installer.Quality)
+	names := []string{installer.Version + ".json"}
+	if latest {
+		names = append(names, "latest.json")
+	}
+
+	for _, name := range names {
+		if err := common.WriteFile(filepath.Join(dir, name), bytes.NewReader(data), 0644); err != nil {
+			return fmt.Errorf("failed to write installer metadata: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// InstallerHistory returns the mirrored builds of the platform and quality,
+// newest first.
+func InstallerHistory(identity, quality string) ([]common.ProductInfoEx, error) {
+	return common.LoadInstallers(ARTIFACTS, identity, quality)
+}
+
+// RetainedInstallers returns the builds the retention rules keep, the newest
+// Installers.Retain builds plus any pinned ones. Builds that are still being
+// rolled out keep the newest build everyone has been offered around as well,
+// and remote builds are kept as long as a client build of their commit is.
+func RetainedInstallers(history []common.ProductInfoEx) ([]common.ProductInfoEx, error) {
+	commits := map[string]bool{}
+	if len(history) > 0 && INSTALLERS.IsRemote(history[0].Identity) {
+		var err error
+		if commits, err = MirroredCommits(history[0].Quality); err != nil {
+			return nil, err
+		}
+	}
+
+	var kept []common.ProductInfoEx
+	complete := false
+	for n, installer := range history {
+		pinned := slices.Contains(INSTALLERS.PinnedCommits(installer.Identity, installer.Quality), installer.Version)
+		if n < max(INSTALLERS.Retain, 1) || pinned || !complete || commits[installer.Version] {
+			kept = append(kept, installer)
+		}
+		complete = complete || INSTALLERS.Rollout.Complete(installer.Version, time.Since(installer.Landed()))
+	}
+
+	return kept, nil
+}
+
+// MirroredCommits returns the commits of the retained client builds of the
+// quality, the commits remote builds are fetched for.
+func MirroredCommits(quality string) (map[string]bool, error) {
+	dirs, err := fs.Glob(ARTIFACTS, path.Join("installers", "*", quality))
+	if err != nil {
+		return nil, fmt.Errorf("failed to glob installers: %w", err)
+	}
+
+	commits := map[string]bool{}
+	for _, dir := range dirs {
+		identity := path.Base(path.Dir(dir))
+		if INSTALLERS.IsRemote(identity) {
+			continue
+		}
+
+		history, err := InstallerHistory(identity, quality)
+		if err != nil {
+			return nil, err
+		}
+
+		kept, err := RetainedInstallers(history)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, installer := range kept {
+			commits[installer.Version] = true
+		}
+	}
+
+	return commits, nil
+}
+
+// DownloadPinnedInstallers mirrors the pinned builds, which are usually older
+// than the latest build the update server reports. Pins without an identity or
+// quality apply to every mirrored client platform or configured quality. An
+// error is returned if any pinned build, including one the update server
+// doesn't know, could not be mirrored.
+func DownloadPinnedInstallers(ctx context.Context, downloader *Downloader) error {
+	var queries []installerQuery
+	for _, pin := range INSTALLERS.Pins {
+		qualities := INSTALLERS.Qualities
+		if pin.Quality != "" {
+			qualities = []string{pin.Quality}
+		}
+
+		for _, quality := range qualities {
+			identities := []string{pin.Identity}
+			if pin.Identity == "" {
+				dirs, err := fs.Glob(ARTIFACTS, path.Join("installers", "*", quality))
+				if err != nil {
+					return fmt.Errorf("failed to glob installers: %w", err)
+				}
+
+				identities = nil
+				for _, dir := range dirs {
+					if identity := path.Base(path.Dir(dir)); !INSTALLERS.IsRemote(identity) {
+						identities = append(identities, identity)
+					}
+				}
+			}
+
+			for _, identity := range identities {
+				platform, architecture, buildType := common.SplitIdentity(identity)
+				queries = append(queries, installerQuery{platform, architecture, buildType, quality, pin.Commit})
+			}
+		}
+	}
+
+	failed := 0
+	for _, query := range queries {
+		identity := common.Identity(query.Platform, query.Architecture, query.BuildType)
+		// a pin that names a missing build is a configuration mistake
+		if err := DownloadCommitInstaller(ctx, downloader, query); errors.Is(err, ErrNotFound) {
+			slog.Warn("pinned build does not exist", "identity", identity, "quality", query.Quality, "commit", query.Commit)
+			failed += 1
+		} else if err != nil {
+			slog.Error("failed to download pinned build", "identity", identity, "quality", query.Quality, "commit", query.Commit, "error", err)
+			failed += 1
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+
+	slog.Info("downloaded pinned installers", "count", len(queries)-failed, "failed", failed)
+	if failed > 0 {
+		return fmt.Errorf("failed to download %d pinned installers", failed)
+	}
+
+	return nil
+}
+
+// DownloadRemoteInstallers mirrors the configured server and cli builds for
+// every mirrored client commit. DownloadInstallerHandler serves them by commit
+// the way update.code.visualstudio.com/commit:{commit}/{platform}/{quality}
+// does.
+func DownloadRemoteInstallers(ctx context.Context, downloader *Downloader) error {
+	queue := make(chan installerQuery)
+	go func() {
+		defer close(queue)
+		for _, quality := range INSTALLERS.Qualities {
+			commits, err := MirroredCommits(quality)
+			if err != nil {
+				slog.Error("failed to list mirrored commits", "quality", quality, "error", err)
+				continue
+			}
+
+			for commit := range commits {
+				for _, identity := range INSTALLERS.Remote {
+					platform, architecture, buildType := common.SplitIdentity(identity)
+					select {
+					case queue <- installerQuery{platform, architecture, buildType, quality, commit}:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	var mu gosync.Mutex
+	count, failed := 0, 0
+	Run(downloader, queue, func(query installerQuery) {
+		identity := common.Identity(query.Platform, query.Architecture, query.BuildType)
+		err := DownloadCommitInstaller(ctx, downloader, query)
+
+		mu.Lock()
+		defer mu.Unlock()
+		if errors.Is(err, ErrNotFound) {
+			slog.Debug("no remote build for commit", "identity", identity, "quality", query.Quality, "commit", query.Commit)
+		} else if err != nil {
+			slog.Error("failed to download remote build", "identity", identity, "quality", query.Quality, "commit", query.Commit, "error", err)
+			failed += 1
+		} else {
+			count += 1
+		}
+	})
+
+	for _, quality := range INSTALLERS.Qualities {
+		for _, identity := range INSTALLERS.Remote {
+			if err := ExpireInstallers(identity, quality); err != nil {
+				slog.Error("failed to expire remote builds", "identity", identity, "quality", quality, "error", err)
+			}
+		}
+	}
+
+	slog.Info("downloaded remote builds", "count", count, "failed", failed)
+	return ctx.Err()
+}
+
+// DownloadCommitInstaller mirrors the build of the platform for a specific
+// commit. ErrNotFound is returned if the update server has no such build.
+func DownloadCommitInstaller(ctx context.Context, downloader *Downloader, query installerQuery) error {
+	identity := common.Identity(query.Platform, query.Architecture, query.BuildType)
+	metadata := path.Join("installers", identity, query.Quality, query.Commit+".json")
+	if _, err := fs.Stat(ARTIFACTS, metadata); err == nil {
+		return nil // already mirrored
+	}
+
+	url := fmt.Sprintf("%s/api/versions/commit:%s/%s/%s", strings.TrimSuffix(UPSTREAM.Update, "/"), query.Commit, identity, query.Quality)
+	installer := common.ProductInfoEx{
+		Identity:     identity,
+		Platform:     query.Platform,
+		Architecture: query.Architecture,
+		BuildType:    query.BuildType,
+		Quality:      query.Quality,
+		Mirrored:     time.Now(),
+	}
+	if err := downloader.GetJson(ctx, url, &installer.ProductInfo); err != nil {
+		return err
+	}
+	installer.UpdateUrl = installer.Url
+
+	if err := DownloadInstaller(ctx, downloader, installer); err != nil {
+		return err
+	}
+
+	return WriteInstaller(installer, false)
+}
+
+// ExpireInstallers removes the builds of the platform and quality that fall
+// outside the retention rules.
+func ExpireInstallers(identity, quality string) error {
+	history, err := InstallerHistory(identity, quality)
+	if err != nil {
+		return err
+	}
+
+	kept, err := RetainedInstallers(history)
+	if err != nil {
+		return err
+	}
+
+	// never remove a file that metadata which stays around still points at
+	referenced := map[string]bool{}
+	var latest common.ProductInfoEx
+	if err := common.LoadJsonFS(ARTIFACTS, path.Join("installers", identity, quality, "latest.json"), &latest); err == nil {
+		kept = append(kept, latest)
+	}
+	for _, installer := range kept {
+		referenced[installer.GetDownloadUrl()] = true
+	}
+
+	for _, installer := range history {
+		if slices.ContainsFunc(kept, func(other common.ProductInfoEx) bool { return other.Version == installer.Version }) {
+			continue
+		}
+
+		slog.Info("removing expired installer", "identity", identity, "quality", quality, "version", installer.ProductVersion, "commit", installer.Version)
+		metadata := path.Join("installers", identity, quality, installer.Version+".json")
+		for _, name := range []string{metadata, installer.GetDownloadUrl()} {
+			if referenced[name] {
+				continue
+			}
+			if err := os.Remove(filepath.Join(ROOT, filepath.FromSlash(name))); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return fmt.Errorf("failed to remove '%s': %w", name, err)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,25 @@
+package sync
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/wandel/vscmirror/config"
+)
+
+func TestDownloadPinnedInstallersMissing(t *testing.T) {
+	testRoot(t)
+
+	// the update server answers unknown commits with a 404
+	server := httptest.NewServer(http.NotFoundHandler())
+	t.Cleanup(server.Close)
+	UPSTREAM.Update = server.URL
+	INSTALLERS.Pins = []config.Pin{{Identity: "win32-x64", Commit: "0123456789abcdef"}}
+
+	downloader := &Downloader{HttpClient: server.Client()}
+	if err := DownloadPinnedInstallers(context.Background(), downloader); err == nil {
+		t.Error("pinning a missing build succeeded")
+	}
+}
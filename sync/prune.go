@@ -0,0 +1,226 @@
+package sync
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/wandel/vscmirror/common"
+	"github.com/wandel/vscmirror/marketplace"
+)
+
+// PruneReport lists the artifacts that are (or would be) removed by Prune.
+type PruneReport struct {
+	Files       []string `json:"files"`
+	Directories []string `json:"directories"`
+	Bytes       int64    `json:"bytes"`
+}
+
+// Prune removes every file under extensions/ and installers/ that is no longer
+// referenced by the mirrored metadata once the current selection and retention
+// rules are applied, followed by any directories left empty. Nothing is
+// removed when dryRun is set.
+func Prune(dryRun bool) (PruneReport, error) {
+	var report PruneReport
+
+	referenced, extensions, err := Referenced()
+	if err != nil {
+		return report, err
+	}
+
+	for _, dir := range []string{"extensions", "installers"} {
+		if _, err := pruneDir(dir, referenced, dryRun, &report); errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return report, err
+		}
+	}
+
+	if dryRun {
+		return report, nil
+	}
+
+	// the metadata has to agree with what is left on disk
+	for _, extension := range extensions {
+		data, err := json.Marshal(extension)
+		if err != nil {
+			return report, fmt.Errorf("failed to marshal extension '%s': %w", extension.Identity(), err)
+		}
+
+		filename := filepath.Join(ROOT, "extensions", extension.Identity(), "latest.json")
+		if err := common.WriteFile(filename, bytes.NewReader(data), 0644); err != nil {
+			return report, fmt.Errorf("failed to write extension metadata: %w", err)
+		}
+	}
+
+	statePath := filepath.Join(ROOT, "sync.json")
+	state, err := LoadState(statePath)
+	if err != nil {
+		return report, fmt.Errorf("failed to load sync state: %w", err)
+	}
+
+	for identity, extension := range state.Extensions {
+		for key := range extension.Hashes {
+			if !referenced[key] {
+				delete(extension.Hashes, key)
+			}
+		}
+
+		if _, ok := extensions[identity]; !ok {
+			delete(state.Extensions, identity)
+		}
+	}
+
+	if err := SaveState(statePath, state); err != nil {
+		return report, err
+	}
+
+	if err := WriteGeneration(); err != nil {
+		return report, err
+	}
+
+	return report, nil
+}
+
+// Referenced returns the artifact relative paths of every file that is still
+// needed, along with the metadata of the approved extensions narrowed down to
+// the versions the current rules keep.
+func Referenced() (map[string]bool, map[string]marketplace.Extension, error) {
+	referenced := map[string]bool{
+		"extensions/selected.json":    true,
+		"extensions/marketplace.json": true,
+		"extensions/featured.json":    true,
+	}
+
+	var selected []string
+	if err := common.LoadJsonFS(ARTIFACTS, "extensions/selected.json", &selected); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, fmt.Errorf("failed to load selected extensions: %w", err)
+	}
+
+	matches, err := fs.Glob(ARTIFACTS, "extensions/*/latest.json")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to glob extensions: %w", err)
+	}
+
+	extensions := map[string]marketplace.Extension{}
+	for _, match := range matches {
+		identity := path.Base(path.Dir(match))
+		if selected != nil && !common.ContainsFold(selected, identity) {
+			continue
+		}
+
+		var extension marketplace.Extension
+		if err := common.LoadJsonFS(ARTIFACTS, match, &extension); err != nil {
+			return nil, nil, fmt.Errorf("failed to load extension metadata: %w", err)
+		}
+
+		extension.Versions = SELECTION.Versions(extension)
+		extension.Versions = RETENTION.Retain(extension)
+		extensions[identity] = extension
+
+		referenced[match] = true
+		for _, version := range extension.Versions {
+			uri := path.Join("extensions", identity, version.Version, version.TargetPlatform)
+			for _, file := range version.Files {
+				referenced[path.Join(uri, file.AssetType)] = true
+			}
+		}
+	}
+
+	dirs, err := fs.Glob(ARTIFACTS, "installers/*/*")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to glob installers: %w", err)
+	}
+
+	for _, dir := range dirs {
+		identity, quality := path.Base(path.Dir(dir)), path.Base(dir)
+		history, err := InstallerHistory(identity, quality)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		kept, err := RetainedInstallers(history)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// remote and pinned only directories have no latest.json
+		latest := path.Join(dir, "latest.json")
+		if _, err := fs.Stat(ARTIFACTS, latest); err == nil || IsClientInstaller(identity, quality) {
+			referenced[latest] = true
+		}
+		for _, installer := range kept {
+			referenced[path.Join(dir, installer.Version+".json")] = true
+			referenced[installer.GetDownloadUrl()] = true
+		}
+	}
+
+	return referenced, extensions, nil
+}
+
+// pruneDir removes the unreferenced files below dir and reports whether dir
+// is (or would be) left empty.
+func pruneDir(dir string, referenced map[string]bool, dryRun bool, report *PruneReport) (bool, error) {
+	entries, err := fs.ReadDir(ARTIFACTS, dir)
+	if err != nil {
+		return false, err
+	}
+
+	empty := true
+	for _, entry := range entries {
+		name := path.Join(dir, entry.Name())
+		if entry.IsDir() {
+			removed, err := pruneDir(name, referenced, dryRun, report)
+			if err != nil {
+				return false, err
+			}
+			empty = empty && removed
+			continue
+		}
+
+		// keep partial downloads of files that are still wanted so they resume
+		if referenced[name] || referenced[strings.TrimSuffix(name, ".partial")] {
+			empty = false
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return false, fmt.Errorf("failed to stat '%s': %w", name, err)
+		}
+
+		slog.Info("orphaned file", "path", name, "size", info.Size(), "dryRun", dryRun)
+		report.Files = append(report.Files, name)
+		report.Bytes += info.Size()
+		if !dryRun {
+			if err := os.Remove(filepath.Join(ROOT, filepath.FromSlash(name))); err != nil {
+				return false, fmt.Errorf("failed to remove '%s': %w", name, err)
+			}
+		}
+	}
+
+	if !empty {
+		return false, nil
+	}
+
+	// the top level directories are kept even when empty
+	if dir == "extensions" || dir == "installers" {
+		return true, nil
+	}
+
+	report.Directories = append(report.Directories, dir)
+	if !dryRun {
+		if err := os.Remove(filepath.Join(ROOT, filepath.FromSlash(dir))); err != nil {
+			return false, fmt.Errorf("failed to remove '%s': %w", dir, err)
+		}
+	}
+
+	return true, nil
+}
@@ -0,0 +1,193 @@
+package sync
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/wandel/vscmirror/common"
+	"github.com/wandel/vscmirror/config"
+	"github.com/wandel/vscmirror/marketplace"
+)
+
+// testRoot points the sync at an empty artifact root mirroring the win32-x64
+// stable client and the cli-alpine-x64 remote build, restoring the previous
+// configuration once the test is done.
+func testRoot(t *testing.T) string {
+	t.Helper()
+
+	root, artifacts, upstream, installers := ROOT, ARTIFACTS, UPSTREAM, INSTALLERS
+	selection, retention := SELECTION, RETENTION
+	t.Cleanup(func() {
+		ROOT, ARTIFACTS, UPSTREAM, INSTALLERS = root, artifacts, upstream, installers
+		SELECTION, RETENTION = selection, retention
+	})
+
+	cfg := config.Default()
+	cfg.Root = t.TempDir()
+	cfg.Installers.Platforms = []string{"win32"}
+	cfg.Installers.Architectures = []string{"x64"}
+	cfg.Installers.BuildTypes = []string{""}
+	cfg.Installers.Remote = []string{"cli-alpine-x64"}
+	Configure(cfg)
+
+	return cfg.Root
+}
+
+// writeTestFile writes data to the artifact relative name and returns its
+// sha256 hash.
+func writeTestFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+
+	filename := filepath.Join(ROOT, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return sha256Hex(data)
+}
+
+// writeTestInstaller mirrors a build of the identity for commit, pointing
+// latest.json at it if latest is set.
+func writeTestInstaller(t *testing.T, identity, commit string, timestamp int, latest bool) common.ProductInfoEx {
+	t.Helper()
+
+	platform, architecture, buildType := common.SplitIdentity(identity)
+	installer := common.ProductInfoEx{
+		ProductInfo: marketplace.ProductInfo{
+			Name:      "1.99.0",
+			Version:   commit,
+			Timestamp: timestamp,
+		},
+		Identity:     identity,
+		Platform:     platform,
+		Architecture: architecture,
+		BuildType:    buildType,
+		Quality:      "stable",
+		UpdateUrl:    "https://update.code.visualstudio.com/" + commit + "/" + identity + "/build.tar.gz",
+	}
+	installer.Url = installer.UpdateUrl
+	installer.SHA256Hash = writeTestFile(t, installer.GetDownloadUrl(), []byte(identity+commit))
+
+	if err := WriteInstaller(installer, latest); err != nil {
+		t.Fatal(err)
+	}
+	return installer
+}
+
+func TestVerifyRemoteOnlyInstallers(t *testing.T) {
+	testRoot(t)
+	writeTestInstaller(t, "win32-x64", "c1", 1, true)
+	writeTestInstaller(t, "cli-alpine-x64", "c1", 1, false)
+
+	report, err := Verify()
+	if err != nil {
+		t.Fatalf("failed to verify: %v", err)
+	}
+
+	if !report.Ok() {
+		data, _ := json.Marshal(report)
+		t.Errorf("healthy store failed verification: %s", data)
+	}
+	if report.Checked != 5 {
+		t.Errorf("checked %d files, want 5", report.Checked)
+	}
+}
+
+func TestVerifyMissingLatest(t *testing.T) {
+	testRoot(t)
+	writeTestInstaller(t, "win32-x64", "c1", 1, false)
+
+	report, err := Verify()
+	if err != nil {
+		t.Fatalf("failed to verify: %v", err)
+	}
+
+	want := "installers/win32-x64/stable/latest.json"
+	if !slices.Equal(report.Missing, []string{want}) {
+		t.Errorf("got missing %v, want %v", report.Missing, []string{want})
+	}
+}
+
+func TestPrune(t *testing.T) {
+	testRoot(t)
+	installer := writeTestInstaller(t, "win32-x64", "c1", 1, true)
+
+	extension := marketplace.Extension{
+		Publisher:     marketplace.Publisher{PublisherName: "acme"},
+		ExtensionName: "app",
+		Versions: []marketplace.ExtensionVersion{{
+			Version: "1.0.0",
+			Files: []marketplace.ExtensionFile{
+				{AssetType: "Microsoft.VisualStudio.Services.VSIXPackage"},
+				{AssetType: "Microsoft.VisualStudio.Services.Icons.Default"},
+			},
+		}},
+	}
+	data, err := json.Marshal(extension)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, "extensions/acme.app/latest.json", data)
+
+	kept := []string{
+		installer.GetDownloadUrl(),
+		"extensions/acme.app/1.0.0/Microsoft.VisualStudio.Services.VSIXPackage",
+		// a download of a wanted file that was interrupted
+		"extensions/acme.app/1.0.0/Microsoft.VisualStudio.Services.Icons.Default.partial",
+	}
+	orphaned := []string{
+		"extensions/acme.app/0.9.0/Microsoft.VisualStudio.Services.VSIXPackage",
+		"extensions/acme.app/0.9.0/Microsoft.VisualStudio.Services.Icons.Default.partial",
+		"installers/win32-x64/stable/stray.zip",
+	}
+	for _, name := range append(slices.Clone(kept), orphaned...) {
+		writeTestFile(t, name, []byte(name))
+	}
+
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(ROOT, filepath.FromSlash(name)))
+		return err == nil
+	}
+
+	report, err := Prune(true)
+	if err != nil {
+		t.Fatalf("failed to prune: %v", err)
+	}
+
+	slices.Sort(report.Files)
+	if want := slices.Sorted(slices.Values(orphaned)); !slices.Equal(report.Files, want) {
+		t.Errorf("got orphaned files %v, want %v", report.Files, want)
+	}
+	if want := []string{"extensions/acme.app/0.9.0"}; !slices.Equal(report.Directories, want) {
+		t.Errorf("got orphaned directories %v, want %v", report.Directories, want)
+	}
+	for _, name := range orphaned {
+		if !exists(name) {
+			t.Errorf("dry run removed '%s'", name)
+		}
+	}
+
+	if _, err := Prune(false); err != nil {
+		t.Fatalf("failed to prune: %v", err)
+	}
+
+	for _, name := range orphaned {
+		if exists(name) {
+			t.Errorf("orphaned '%s' was not removed", name)
+		}
+	}
+	if exists("extensions/acme.app/0.9.0") {
+		t.Error("empty version directory was not removed")
+	}
+	for _, name := range kept {
+		if !exists(name) {
+			t.Errorf("referenced '%s' was removed", name)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package sync
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/wandel/vscmirror/common"
+	"github.com/wandel/vscmirror/marketplace"
+)
+
+// State is persisted between runs so that only extensions which changed since
+// the last successful sync need to be fetched again.
+type State struct {
+	LastSync time.Time `json:"lastSync"`
+	// Rules holds the selection and retention rules LastSync was made with.
+	Rules      string                    `json:"rules"`
+	Extensions map[string]ExtensionState `json:"extensions"`
+}
+
+type ExtensionState struct {
+	// Version is the latest version that was mirrored, after the selection and
+	// retention rules were applied.
+	Version string `json:"version"`
+	// Upstream is the latest version the marketplace listed at the time, which
+	// differs from Version when that is filtered out, e.g. a pre-release.
+	Upstream    string    `json:"upstream,omitempty"`
+	LastUpdated time.Time `json:"lastUpdated"`
+	// Dependency is set when the extension is only mirrored because a selected
+	// extension depends on it.
+	Dependency bool `json:"dependency,omitempty"`
+	// Hashes maps the artifact relative path of each asset to its sha256 hash.
+	Hashes map[string]string `json:"hashes"`
+}
+
+// Changed reports whether the extension has been updated since it was recorded.
+func (state ExtensionState) Changed(extension marketplace.Extension) bool {
+	// states written before Upstream was recorded only have the mirrored version
+	upstream := state.Upstream
+	if upstream == "" {
+		upstream = state.Version
+	}
+
+	if len(extension.Versions) == 0 {
+		return true
+	} else if upstream != extension.Versions[0].Version {
+		return true
+	}
+
+	return extension.LastUpdated.After(state.LastUpdated)
+}
+
+// UpstreamVersion returns the latest version of the extension as listed by the
+// marketplace, before PrepareExtension filters the versions.
+func UpstreamVersion(extension marketplace.Extension) string {
+	if len(extension.Versions) == 0 {
+		return ""
+	}
+	return extension.Versions[0].Version
+}
+
+func LoadState(filename string) (State, error) {
+	state := State{
+		Extensions: map[string]ExtensionState{},
+	}
+
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return state, nil
+	} else if err != nil {
+		return state, fmt.Errorf("failed to read '%s': %w", filename, err)
+	}
+
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("failed to json decode '%s': %w", filename, err)
+	}
+
+	if state.Extensions == nil {
+		state.Extensions = map[string]ExtensionState{}
+	}
+
+	return state, nil
+}
+
+func SaveState(filename string, state State) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal sync state: %w", err)
+	}
+
+	if err := common.WriteFile(filename, bytes.NewReader(data), 0644); err != nil {
+		return fmt.Errorf("failed to write sync state: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,39 @@
+package sync
+
+import (
+	"testing"
+	"time"
+
+	"github.com/wandel/vscmirror/marketplace"
+)
+
+func TestExtensionStateChanged(t *testing.T) {
+	updated := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	listed := func(version string) marketplace.Extension {
+		return marketplace.Extension{
+			LastUpdated: updated,
+			Versions:    []marketplace.ExtensionVersion{{Version: version}},
+		}
+	}
+
+	tests := []struct {
+		name      string
+		state     ExtensionState
+		extension marketplace.Extension
+		want      bool
+	}{
+		{"unchanged", ExtensionState{Version: "1.0.0", Upstream: "1.0.0", LastUpdated: updated}, listed("1.0.0"), false},
+		{"new version", ExtensionState{Version: "1.0.0", Upstream: "1.0.0", LastUpdated: updated}, listed("1.1.0"), true},
+		// the latest version is a pre-release the selection filtered out
+		{"filtered latest", ExtensionState{Version: "1.0.0", Upstream: "1.1.0", LastUpdated: updated}, listed("1.1.0"), false},
+		{"state without upstream", ExtensionState{Version: "1.0.0", LastUpdated: updated}, listed("1.0.0"), false},
+		{"republished", ExtensionState{Version: "1.0.0", Upstream: "1.0.0", LastUpdated: updated.Add(-time.Hour)}, listed("1.0.0"), true},
+		{"no versions", ExtensionState{Version: "1.0.0", Upstream: "1.0.0", LastUpdated: updated}, marketplace.Extension{LastUpdated: updated}, true},
+	}
+
+	for _, test := range tests {
+		if got := test.state.Changed(test.extension); got != test.want {
+			t.Errorf("%s: Changed() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
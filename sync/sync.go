@@ -1,89 +1,316 @@
 package sync
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"iter"
 	"log/slog"
-	"net/http"
 	"os"
 	"path"
 	"path/filepath"
+	"slices"
+	"strings"
+	gosync "sync"
+	"time"
 
 	"github.com/wandel/vscmirror/common"
+	"github.com/wandel/vscmirror/config"
 	"github.com/wandel/vscmirror/marketplace"
 )
 
-var ARTIFACTS = os.DirFS("D:\\vscmirror")
+var ROOT = "D:\\vscmirror"
+var ARTIFACTS = os.DirFS(ROOT)
+var UPSTREAM = config.Default().Upstream
+var INSTALLERS = config.Default().Installers
+var SELECTION = config.Default().Selection
+var RETENTION = config.Default().Retention
 
-func DownloadInstallers(ctx context.Context) error {
-	var response struct {
-		Products []marketplace.ProductInfo `json:"products"`
+// Configure points the sync at the artifact root and upstreams of cfg.
+func Configure(cfg config.Config) {
+	ROOT = cfg.Root
+	ARTIFACTS = cfg.Artifacts()
+	UPSTREAM = cfg.Upstream
+	INSTALLERS = cfg.Installers
+	SELECTION = cfg.Selection
+	RETENTION = cfg.Retention
+}
+
+// DownloadExtensions mirrors the marketplace into ROOT. The first run walks the
+// whole catalog, later runs only look at extensions updated since the last
+// successful sync recorded in sync.json.
+func DownloadExtensions(ctx context.Context, client *marketplace.Client, downloader *Downloader) error {
+	statePath := filepath.Join(ROOT, "sync.json")
+	state, err := LoadState(statePath)
+	if err != nil {
+		return fmt.Errorf("failed to load sync state: %w", err)
+	}
+
+	// extensions or versions that were skipped under the old rules may be
+	// wanted now, which an incremental sync would not notice.
+	rules, err := json.Marshal(struct {
+		Selection config.Selection
+		Retention config.Retention
+	}{SELECTION, RETENTION})
+	if err != nil {
+		return fmt.Errorf("failed to marshal mirror rules: %w", err)
 	}
 
-	url := "https://code.visualstudio.com/sha?build"
-	if err := common.DownloadJson(url, &response); err != nil {
-		return fmt.Errorf("failed to get list of latest installers: %w", err)
+	force := state.Rules != string(rules)
+	if force {
+		slog.Info("mirror rules changed, performing full sync")
+		state.LastSync = time.Time{}
+		state.Rules = string(rules)
 	}
 
-	for _, installer := range response.Products {
-		_, name := path.Split(installer.Url)
-		slog.Info(name, "platform", installer.Platform.OperatingSystem, "build", installer.Build)
+	started := time.Now()
+	extensions := client.GetAllExtensions(ctx)
+	if names, ok := SELECTION.Include.Explicit(); ok {
+		// the dependencies have to be kept up to date as well
+		names = slices.Clone(names)
+		for identity, previous := range state.Extensions {
+			if previous.Dependency && !common.ContainsFold(names, identity) {
+				names = append(names, identity)
+			}
+		}
+		slog.Info("querying the selected extensions by name", "count", len(names))
+		extensions = namedExtensions(ctx, client, names)
+	} else if !state.LastSync.IsZero() {
+		slog.Info("performing incremental sync", "since", state.LastSync)
+		extensions = client.GetUpdatedExtensions(ctx, state.LastSync)
 	}
 
-	// https://code.visualstudio.com/sha?build=stable
-	// https://code.visualstudio.com/sha?build=insiders
-	// if err := os.MkdirAll("installers", 0644); err != nil {
-	// 	return fmt.Errorf("failed to create installers directory: %w", err)
-	// }
+	var mu gosync.Mutex
+	count, failed := 0, 0
+	queue := make(chan marketplace.Extension)
+	go func() {
+		defer close(queue)
+		for extension, err := range extensions {
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				slog.Error("failed to list extensions", "error", err)
+				mu.Lock()
+				failed += 1
+				mu.Unlock()
+				continue
+			}
 
-	return nil
+			mu.Lock()
+			previous, ok := state.Extensions[extension.Identity()]
+			mu.Unlock()
+			if !SELECTION.Selected(extension) && !previous.Dependency {
+				continue
+			}
+
+			if !slices.ContainsFunc(extension.Versions, SELECTION.PlatformSelected) {
+				slog.Debug("extension has no builds for the selected platforms", "extension", extension.Identity())
+				continue
+			}
+
+			if ok && !force && !previous.Changed(extension) {
+				continue
+			}
+
+			select {
+			case queue <- extension:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	Run(downloader, queue, func(extension marketplace.Extension) {
+		identity := extension.Identity()
+		mu.Lock()
+		previous := state.Extensions[identity]
+		mu.Unlock()
+
+		upstream := UpstreamVersion(extension)
+		extension, err := PrepareExtension(ctx, client, extension)
+		if err == nil {
+			var current ExtensionState
+			current, err = DownloadExtension(ctx, downloader, extension, previous)
+			current.Upstream = upstream
+			current.Dependency = previous.Dependency
+			previous = current
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			slog.Error("failed to download extension", "extension", identity, "error", err)
+			failed += 1
+			return
+		}
+		state.Extensions[identity] = previous
+		count += 1
+	})
+
+	// only move the sync point forward when nothing was missed, otherwise the
+	// failed extensions would be skipped by the next incremental run.
+	if failed == 0 && ctx.Err() == nil {
+		state.LastSync = started
+	}
+
+	selected := LoadSelected(state)
+	required := ResolveDependencies(ctx, client, downloader, state, selected)
+
+	// an extension can stop being selected but still be needed by another one,
+	// incremental runs only keep it up to date if it is marked as a dependency
+	for identity, extension := range state.Extensions {
+		extension.Dependency = required[identity]
+		state.Extensions[identity] = extension
+	}
+
+	if err := WriteSelected(state, selected, required); err != nil {
+		return err
+	}
+
+	if err := SaveState(statePath, state); err != nil {
+		return err
+	}
+
+	if err := WriteGeneration(); err != nil {
+		return err
+	}
+
+	slog.Info("downloaded extensions", "count", count, "failed", failed)
+	return ctx.Err()
 }
 
-func DownloadInstaller(ctx context.Context, platform, channel, commit string) error {
-	path := filepath.Join("installers", platform, channel)
-	if err := os.MkdirAll(path, 0644); err != nil {
-		return fmt.Errorf("failed to create '%s': %w", path, err)
+// PrepareExtension narrows the extension down to the versions that should be
+// mirrored, fetching its full version history first if the retention rules
+// need more than the latest version or the latest version is a pre-release,
+// as the newest stable version is then missing.
+func PrepareExtension(ctx context.Context, client *marketplace.Client, extension marketplace.Extension) (marketplace.Extension, error) {
+	preRelease := slices.ContainsFunc(extension.Versions, marketplace.ExtensionVersion.IsPreRelease)
+	if RETENTION.AllVersions() || preRelease {
+		full, err := client.GetExtensionVersions(ctx, extension.Identity())
+		if err != nil {
+			return extension, fmt.Errorf("failed to get versions of '%s': %w", extension.Identity(), err)
+		}
+		extension.Versions = full.Versions
+	}
+
+	extension.Versions = SELECTION.Versions(extension)
+	extension.Versions = RETENTION.Retain(extension)
+	return extension, nil
+}
+
+// DownloadExtension fetches every asset of every version of the extension into
+// extensions/{publisher.name}/{version}/{targetPlatform}/{assetType}, matching
+// the urls the server rewrites to, and then writes the latest.json metadata.
+// Assets already recorded in previous are not downloaded again.
+func DownloadExtension(ctx context.Context, downloader *Downloader, extension marketplace.Extension, previous ExtensionState) (ExtensionState, error) {
+	identity := extension.Identity()
+	state := ExtensionState{
+		LastUpdated: extension.LastUpdated,
+		Hashes:      map[string]string{},
+	}
+	if len(extension.Versions) > 0 {
+		state.Version = extension.Versions[0].Version
+	}
+
+	for _, version := range extension.Versions {
+		uri := path.Join("extensions", identity, version.Version, version.TargetPlatform)
+		for _, file := range version.Files {
+			if err := ctx.Err(); err != nil {
+				return state, err
+			}
+
+			key := path.Join(uri, file.AssetType)
+			filename := filepath.Join(ROOT, filepath.FromSlash(key))
+			if hash, ok := previous.Hashes[key]; ok {
+				if _, err := os.Stat(filename); err == nil {
+					state.Hashes[key] = hash
+					continue // already downloaded
+				}
+			}
+
+			slog.Debug("downloading extension asset", "extension", identity, "version", version.Version, "target", version.TargetPlatform, "asset", file.AssetType)
+			hash, err := downloader.Download(ctx, file.Source, filename, previous.Hashes[key])
+			if err != nil {
+				return state, fmt.Errorf("failed to download '%s' for %s@%s: %w", file.AssetType, identity, version.Version, err)
+			}
+			state.Hashes[key] = hash
+		}
 	}
-	url := fmt.Sprintf("https://update.code.visualstudio.com/api/update/%s/%s/%s", platform, channel, commit)
-	resp, err := http.Get(url)
+
+	// latest.json is written last so the server never advertises an extension
+	// whose assets are still missing.
+	data, err := json.Marshal(extension)
 	if err != nil {
-		return fmt.Errorf("failed to download installer: %w", err)
+		return state, fmt.Errorf("failed to marshal extension '%s': %w", identity, err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	filename := filepath.Join(ROOT, "extensions", identity, "latest.json")
+	if err := common.WriteFile(filename, bytes.NewReader(data), 0644); err != nil {
+		return state, fmt.Errorf("failed to write extension metadata: %w", err)
 	}
 
-	if err := common.WriteFile(fmt.Sprintf("installers/%s-%s.exe", platform, channel), resp.Body, 0644); err != nil {
-		return fmt.Errorf("failed to write installer: %w", err)
+	return state, nil
+}
+
+// LoadSelected returns the metadata of every mirrored extension that is
+// approved by the selection rules.
+func LoadSelected(state State) map[string]marketplace.Extension {
+	selected := map[string]marketplace.Extension{}
+	for identity := range state.Extensions {
+		extension, err := loadExtension(identity)
+		if err != nil {
+			slog.Warn("failed to load extension metadata", "extension", identity, "error", err)
+			continue
+		}
+
+		if SELECTION.Selected(extension) {
+			selected[identity] = extension
+		}
 	}
 
-	return nil
+	return selected
 }
 
-func DownloadExtensions(ctx context.Context) error {
-	if err := os.MkdirAll("extensions", 0644); err != nil {
-		return fmt.Errorf("failed to create installers directory: %w", err)
+// WriteSelected forgets every extension that is neither selected nor required
+// by a selected extension and records the rest in extensions/selected.json
+// for the server.
+func WriteSelected(state State, selected map[string]marketplace.Extension, required map[string]bool) error {
+	approved := []string{}
+	for identity := range state.Extensions {
+		if _, ok := selected[identity]; ok {
+			approved = append(approved, identity)
+		} else if required[identity] {
+			approved = append(approved, identity)
+		} else {
+			slog.Info("extension is no longer selected", "extension", identity)
+			delete(state.Extensions, identity)
+		}
 	}
+	slices.Sort(approved)
 
-	client := marketplace.Client{
-		HttpClient: http.DefaultClient,
-		Version:    "1.99.2",
+	data, err := json.MarshalIndent(approved, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal selected extensions: %w", err)
 	}
 
-	var extensions []marketplace.Extension
-	for extension := range client.GetAllExtensions(ctx) {
-		extensions = append(extensions, extension)
+	filename := filepath.Join(ROOT, "extensions", "selected.json")
+	if err := common.WriteFile(filename, bytes.NewReader(data), 0644); err != nil {
+		return fmt.Errorf("failed to write selected extensions: %w", err)
 	}
 
-	if data, err := json.Marshal(extensions); err != nil {
-		return fmt.Errorf("failed to marshal extensions: %w", err)
-	} else if err := os.WriteFile("extensions.json", data, 0644); err != nil {
-		return fmt.Errorf("failed to write extensions: %w", err)
-	} else {
-		slog.Info("downloaded extensions", "count", len(extensions))
+	slog.Info("recorded selected extensions", "count", len(approved))
+	return nil
+}
+
+// WriteGeneration marks the artifact root as changed, telling a running server
+// to reload its catalog.
+func WriteGeneration() error {
+	generation := time.Now().UTC().Format(time.RFC3339Nano)
+	filename := filepath.Join(ROOT, common.GenerationFile)
+	if err := common.WriteFile(filename, strings.NewReader(generation), 0644); err != nil {
+		return fmt.Errorf("failed to write generation marker: %w", err)
 	}
 
 	return nil
@@ -94,16 +321,47 @@ func DownloadExtensions(ctx context.Context) error {
 // 	return nil
 // }
 
-func DownloadMalicious(ctx context.Context) error {
-	url := "https://main.vscode-cdn.net/extensions/marketplace.json"
-	path := "extensions/marketplace.json"
-	if err := common.Download(url, path); err != nil {
+func DownloadMalicious(ctx context.Context, downloader *Downloader) error {
+	url := UPSTREAM.Cdn + "/extensions/marketplace.json"
+	path := filepath.Join(ROOT, "extensions", "marketplace.json")
+	if _, err := downloader.Download(ctx, url, path, ""); err != nil {
 		return fmt.Errorf("failed to download marketplace.json")
 	}
 
 	return nil
 }
 
+// DownloadFeatured records the extensions the marketplace features in
+// extensions/featured.json, serve answers @featured queries from it.
+func DownloadFeatured(ctx context.Context, client *marketplace.Client) error {
+	criteria := []marketplace.FilterCriteria{
+		{FilterType: marketplace.FilterTypeInstallationTarget, Value: marketplace.InstallationTargetVSCode},
+		{FilterType: marketplace.FilterTypeFeatured},
+		{FilterType: marketplace.FilterTypeExcludeWithFlags, Value: "4096"},
+	}
+
+	featured := []string{}
+	for extension, err := range client.GetExtensions(ctx, criteria, marketplace.SortByInstallCount) {
+		if err != nil {
+			return fmt.Errorf("failed to query featured extensions: %w", err)
+		}
+		featured = append(featured, extension.Identity())
+	}
+
+	data, err := json.Marshal(featured)
+	if err != nil {
+		return fmt.Errorf("failed to marshal featured extensions: %w", err)
+	}
+
+	filename := filepath.Join(ROOT, "extensions", "featured.json")
+	if err := common.WriteFile(filename, bytes.NewReader(data), 0644); err != nil {
+		return fmt.Errorf("failed to write featured extensions: %w", err)
+	}
+
+	slog.Info("recorded featured extensions", "count", len(featured))
+	return nil
+}
+
 // func DownloadRecomendations(ctx context.Context) error {
 // 	url := "https://az764295.vo.msecnd.net/extensions/workspaceRecommendations.json.gz"
 // 	path := "extensions/workspaceRecommendations.json.gz"
@@ -113,3 +371,34 @@ func DownloadMalicious(ctx context.Context) error {
 
 // 	return nil
 // }
+
+// namedExtensions looks up the extensions with the "publisher.name" identifiers
+// a batch at a time, which is far cheaper than walking the whole marketplace
+// for a handful of extensions. Names the marketplace doesn't know are logged.
+func namedExtensions(ctx context.Context, client *marketplace.Client, names []string) iter.Seq2[marketplace.Extension, error] {
+	return func(yield func(marketplace.Extension, error) bool) {
+		for batch := range slices.Chunk(names, dependencyBatchSize) {
+			extensions, err := client.GetExtensionsByName(ctx, batch)
+			if err != nil {
+				if !yield(marketplace.Extension{}, err) {
+					return
+				}
+				continue
+			}
+
+			for _, name := range batch {
+				if !slices.ContainsFunc(extensions, func(extension marketplace.Extension) bool {
+					return strings.EqualFold(extension.Identity(), name)
+				}) {
+					slog.Warn("selected extension not found in the marketplace", "extension", name)
+				}
+			}
+
+			for _, extension := range extensions {
+				if !yield(extension, nil) {
+					return
+				}
+			}
+		}
+	}
+}
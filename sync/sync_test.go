@@ -0,0 +1,173 @@
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/wandel/vscmirror/marketplace"
+)
+
+// testMarketplace is a fake gallery serving extensions from /extensionquery
+// and their assets from /cdn, counting the asset downloads.
+type testMarketplace struct {
+	extensions []marketplace.Extension
+	downloads  atomic.Int32
+}
+
+func (m *testMarketplace) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/extensionquery" {
+		m.downloads.Add(1)
+		w.Write([]byte(r.URL.Path))
+		return
+	}
+
+	var request marketplace.QueryRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	filter := request.Filters[0]
+	matches := filter.Filter(m.extensions, nil)
+
+	var response marketplace.QueryResponse
+	start := min((filter.PageNumber-1)*filter.PageSize, len(matches))
+	response.Extensions = matches[start:min(start+filter.PageSize, len(matches))]
+	response.ResultMetadata = []marketplace.QueryResultMetadata{{
+		MetadataType:  "ResultCount",
+		MetadataItems: []marketplace.MetadataItem{{Name: "TotalCount", Count: len(matches)}},
+	}}
+
+	json.NewEncoder(w).Encode(map[string]any{"results": []marketplace.QueryResponse{response}})
+}
+
+// testExtension returns an extension with a single universal version whose
+// package is served from cdn.
+func testExtension(cdn, identity, category string, dependencies ...string) marketplace.Extension {
+	publisher, name, _ := strings.Cut(identity, ".")
+	source := cdn + "/cdn/" + identity + "/1.0.0/vsix"
+	return marketplace.Extension{
+		Publisher:     marketplace.Publisher{PublisherName: publisher},
+		ExtensionId:   identity,
+		ExtensionName: name,
+		LastUpdated:   time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+		Categories:    []string{category},
+		Versions: []marketplace.ExtensionVersion{{
+			Version: "1.0.0",
+			Files:   []marketplace.ExtensionFile{{AssetType: "Microsoft.VisualStudio.Services.VSIXPackage", Source: source}},
+			Properties: []marketplace.ExtensionProperty{{
+				Key:   marketplace.PropertyExtensionDependencies,
+				Value: strings.Join(dependencies, ","),
+			}},
+		}},
+	}
+}
+
+// newTestMarketplace starts a fake gallery with acme.app, which depends on
+// acme.lib, and an unrelated other.theme, each in their own category.
+func newTestMarketplace(t *testing.T) (*testMarketplace, *marketplace.Client, *Downloader) {
+	gallery := &testMarketplace{}
+	server := httptest.NewServer(gallery)
+	t.Cleanup(server.Close)
+	gallery.extensions = []marketplace.Extension{
+		testExtension(server.URL, "acme.app", "Programming Languages", "acme.lib"),
+		testExtension(server.URL, "acme.lib", "Other"),
+		testExtension(server.URL, "other.theme", "Themes"),
+	}
+
+	client := &marketplace.Client{HttpClient: server.Client(), BaseUrl: server.URL}
+	downloader := &Downloader{HttpClient: server.Client()}
+	return gallery, client, downloader
+}
+
+func TestDownloadExtensions(t *testing.T) {
+	root := testRoot(t)
+	SELECTION.Include.Categories = []string{"Programming Languages"}
+
+	gallery, client, downloader := newTestMarketplace(t)
+	if err := DownloadExtensions(context.Background(), client, downloader); err != nil {
+		t.Fatalf("failed to download extensions: %v", err)
+	}
+
+	for _, identity := range []string{"acme.app", "acme.lib"} {
+		name := filepath.Join(root, "extensions", identity, "1.0.0", "Microsoft.VisualStudio.Services.VSIXPackage")
+		if data, err := os.ReadFile(name); err != nil {
+			t.Errorf("failed to read the package of %s: %v", identity, err)
+		} else if want := "/cdn/" + identity + "/1.0.0/vsix"; string(data) != want {
+			t.Errorf("got package %q for %s, want %q", data, identity, want)
+		}
+		if _, err := os.Stat(filepath.Join(root, "extensions", identity, "latest.json")); err != nil {
+			t.Errorf("missing metadata of %s: %v", identity, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "extensions", "other.theme")); !os.IsNotExist(err) {
+		t.Errorf("unselected extension was mirrored: %v", err)
+	}
+
+	state, err := LoadState(filepath.Join(root, "sync.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.LastSync.IsZero() {
+		t.Error("sync point was not recorded")
+	}
+	if len(state.Extensions) != 2 || state.Extensions["acme.app"].Dependency || !state.Extensions["acme.lib"].Dependency {
+		t.Errorf("got extension states %+v, want acme.app selected and acme.lib as its dependency", state.Extensions)
+	}
+
+	var selected []string
+	data, err := os.ReadFile(filepath.Join(root, "extensions", "selected.json"))
+	if err != nil {
+		t.Fatal(err)
+	} else if err := json.Unmarshal(data, &selected); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"acme.app", "acme.lib"}; !slices.Equal(selected, want) {
+		t.Errorf("got selected %v, want %v", selected, want)
+	}
+
+	// nothing changed upstream, so the incremental run downloads nothing
+	downloads := gallery.downloads.Load()
+	if err := DownloadExtensions(context.Background(), client, downloader); err != nil {
+		t.Fatalf("failed to download extensions again: %v", err)
+	}
+	if n := gallery.downloads.Load() - downloads; n != 0 {
+		t.Errorf("incremental sync downloaded %d assets", n)
+	}
+}
+
+func TestDownloadExtensionsDependencyFlag(t *testing.T) {
+	root := testRoot(t)
+	SELECTION.Include.Categories = []string{"Programming Languages", "Other"}
+
+	_, client, downloader := newTestMarketplace(t)
+	if err := DownloadExtensions(context.Background(), client, downloader); err != nil {
+		t.Fatalf("failed to download extensions: %v", err)
+	}
+
+	// acme.lib is no longer selected but acme.app still needs it
+	SELECTION.Include.Categories = []string{"Programming Languages"}
+	if err := DownloadExtensions(context.Background(), client, downloader); err != nil {
+		t.Fatalf("failed to download extensions again: %v", err)
+	}
+
+	state, err := LoadState(filepath.Join(root, "sync.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if extension, ok := state.Extensions["acme.lib"]; !ok || !extension.Dependency {
+		t.Errorf("got acme.lib state %+v, want it kept as a dependency", extension)
+	}
+	if state.Extensions["acme.app"].Dependency {
+		t.Error("selected acme.app is marked as a dependency")
+	}
+}
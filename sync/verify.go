@@ -0,0 +1,168 @@
+package sync
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/wandel/vscmirror/common"
+)
+
+const AssetTypeVSIXPackage = "Microsoft.VisualStudio.Services.VSIXPackage"
+
+// VerifyReport lists the problems found in the artifact store.
+type VerifyReport struct {
+	Checked int       `json:"checked"`
+	Missing []string  `json:"missing"`
+	Corrupt []Problem `json:"corrupt"`
+	Extra   []string  `json:"extra"`
+}
+
+type Problem struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+func (r VerifyReport) Ok() bool {
+	return len(r.Missing) == 0 && len(r.Corrupt) == 0 && len(r.Extra) == 0
+}
+
+// Verify checks that every file referenced by the mirrored metadata exists,
+// matches its recorded sha256 hash and, for VSIX packages, is a readable
+// extension archive. Files nothing references are reported as extra.
+func Verify() (VerifyReport, error) {
+	report := VerifyReport{
+		Missing: []string{},
+		Corrupt: []Problem{},
+		Extra:   []string{},
+	}
+
+	referenced, _, err := Referenced()
+	if err != nil {
+		return report, err
+	}
+
+	hashes, err := recordedHashes()
+	if err != nil {
+		return report, err
+	}
+
+	// written by the sync when available, but not required
+	optional := []string{"extensions/selected.json", "extensions/marketplace.json", "extensions/featured.json"}
+
+	for _, name := range slices.Sorted(maps.Keys(referenced)) {
+		info, err := fs.Stat(ARTIFACTS, name)
+		if errors.Is(err, fs.ErrNotExist) {
+			if !slices.Contains(optional, name) {
+				report.Missing = append(report.Missing, name)
+			}
+			continue
+		} else if err != nil {
+			return report, fmt.Errorf("failed to stat '%s': %w", name, err)
+		} else if info.IsDir() {
+			report.Corrupt = append(report.Corrupt, Problem{name, "expected a file, found a directory"})
+			continue
+		}
+
+		report.Checked += 1
+		filename := filepath.Join(ROOT, filepath.FromSlash(name))
+		if expected, ok := hashes[name]; ok && expected != "" {
+			actual, err := common.HashFile(filename)
+			if err != nil {
+				return report, err
+			} else if !strings.EqualFold(expected, actual) {
+				report.Corrupt = append(report.Corrupt, Problem{name, fmt.Sprintf("sha256 mismatch: expected %s, got %s", expected, actual)})
+				continue
+			}
+		}
+
+		if path.Base(name) == AssetTypeVSIXPackage {
+			if err := verifyVSIX(filename); err != nil {
+				report.Corrupt = append(report.Corrupt, Problem{name, err.Error()})
+			}
+		}
+	}
+
+	for _, dir := range []string{"extensions", "installers"} {
+		err := fs.WalkDir(ARTIFACTS, dir, func(name string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			} else if d.IsDir() || referenced[name] {
+				return nil
+			} else if strings.HasSuffix(name, ".partial") && referenced[strings.TrimSuffix(name, ".partial")] {
+				return nil // an interrupted download that the next sync resumes
+			}
+
+			report.Extra = append(report.Extra, name)
+			return nil
+		})
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return report, fmt.Errorf("failed to walk '%s': %w", dir, err)
+		}
+	}
+
+	slog.Info("verified artifacts", "checked", report.Checked, "missing", len(report.Missing), "corrupt", len(report.Corrupt), "extra", len(report.Extra))
+	return report, nil
+}
+
+// recordedHashes returns the sha256 hashes the sync recorded for extension
+// assets and the upstream published hashes of the installers.
+func recordedHashes() (map[string]string, error) {
+	hashes := map[string]string{}
+
+	state, err := LoadState(filepath.Join(ROOT, "sync.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load sync state: %w", err)
+	}
+
+	for _, extension := range state.Extensions {
+		maps.Copy(hashes, extension.Hashes)
+	}
+
+	err = fs.WalkDir(ARTIFACTS, "installers", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		} else if d.IsDir() || path.Ext(name) != ".json" {
+			return nil
+		}
+
+		var installer common.ProductInfoEx
+		if err := common.LoadJsonFS(ARTIFACTS, name, &installer); err != nil {
+			return err
+		}
+		hashes[installer.GetDownloadUrl()] = installer.SHA256Hash
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to walk installers: %w", err)
+	}
+
+	return hashes, nil
+}
+
+// verifyVSIX checks that the file is a zip holding a vsix manifest and the
+// extension's package.json.
+func verifyVSIX(filename string) error {
+	r, err := zip.OpenReader(filename)
+	if err != nil {
+		return fmt.Errorf("not a readable zip: %w", err)
+	}
+	defer r.Close()
+
+	for _, required := range []string{"extension.vsixmanifest", "extension/package.json"} {
+		f, err := r.Open(required)
+		if err != nil {
+			return fmt.Errorf("missing '%s'", required)
+		}
+		f.Close()
+	}
+
+	return nil
+}